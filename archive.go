@@ -0,0 +1,216 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// imageExts holds the extensions of image files that can be decoded, for
+// picking images out of archives.
+var imageExts = map[string]bool{
+	".png":  true,
+	".jpg":  true,
+	".jpeg": true,
+	".gif":  true,
+	".tif":  true,
+	".tiff": true,
+	".bmp":  true,
+}
+
+// archiveEntries holds the name inside the archive of every image extracted
+// from an archive, by its extracted path.
+var archiveEntries = make(map[string]string)
+
+// isArchive returns true if the path has a zip or tar file extension.
+func isArchive(path string) bool {
+	lower := strings.ToLower(path)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractArchive extracts the images in the zip or tar archive into a
+// temporary directory, and returns their paths in the order they're stored
+// in the archive. Other files are skipped with a warning.
+func extractArchive(path string) ([]string, error) {
+	dir, err := makeTempDir()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0)
+	// extract writes one archive entry to the temporary directory
+	extract := func(name string, r io.Reader) error {
+		if !imageExts[strings.ToLower(filepath.Ext(name))] {
+			warn("skipping '%s' in '%s', it's not an image", name, path)
+			return nil
+		}
+		// Keep the directory structure, so names don't collide, but don't
+		// allow paths outside the directory
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		if !strings.HasPrefix(dst, dir+string(filepath.Separator)) {
+			return fmt.Errorf("bad file path '%s'", name)
+		}
+		err := os.MkdirAll(filepath.Dir(dst), 0755)
+		if err != nil {
+			return err
+		}
+		f, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		paths = append(paths, dst)
+		archiveEntries[dst] = name
+		return nil
+	}
+
+	if strings.HasSuffix(strings.ToLower(path), ".zip") {
+		err = extractZip(path, extract)
+	} else {
+		err = extractTar(path, extract)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive '%s': %w", path, err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no images found in archive '%s'", path)
+	}
+	return paths, nil
+}
+
+// checkArchiveNames returns an error if two images from archives would be
+// written to the same output file. Output files are named after the image
+// without its directory or extension, so "a/img.png" and "b/img.png" would
+// overwrite each other.
+func checkArchiveNames(paths []string) error {
+	seen := make(map[string]string)
+	for _, path := range paths {
+		entry, ok := archiveEntries[path]
+		if !ok {
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		if prev, ok := seen[name]; ok && prev != entry {
+			return fmt.Errorf(
+				"'%s' and '%s' in the input archives would both be written as '%s', use --number to name outputs by their order instead",
+				prev, entry, name,
+			)
+		}
+		seen[name] = entry
+	}
+	return nil
+}
+
+func extractZip(path string, extract func(string, io.Reader) error) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = extract(zf.Name, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTar(path string, extract func(string, io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	lower := strings.ToLower(path)
+	if strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		err = extract(hdr.Name, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeZip writes every file in the directory into a new zip file at path,
+// sorted by name.
+func writeZip(dir, path string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	f, _, err := openOutFile(path)
+	if err != nil {
+		return fmt.Errorf("error creating zip: %w", err)
+	}
+	// Closed below when it worked, which moves it into place
+	defer f.Abort()
+
+	zw := zip.NewWriter(f)
+	for _, entry := range entries {
+		// Images are already compressed
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: entry.Name(), Method: zip.Store})
+		if err != nil {
+			return fmt.Errorf("error writing zip '%s': %w", path, err)
+		}
+		src, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, src)
+		src.Close()
+		if err != nil {
+			return fmt.Errorf("error writing zip '%s': %w", path, err)
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		return fmt.Errorf("error writing zip '%s': %w", path, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"image"
+	"image/color"
+	"io"
+	"sort"
+)
+
+// defaultCharset is the ASCII character ramp, from the darkest color to the
+// lightest. It's meant for dark text on a light background.
+const defaultCharset = "@%#*+=-:. "
+
+// charset holds the characters that palette colors are mapped to, from
+// darkest to lightest. It's set in preProcess.
+var charset []rune
+
+// paletteChars returns the character for each palette color. Colors are
+// ranked by luminance, and spread evenly across the charset.
+func paletteChars(pal []color.Color) []rune {
+	order := make([]int, len(pal))
+	lums := make([]uint16, len(pal))
+	for i, c := range pal {
+		order[i] = i
+		lums[i] = color.Gray16Model.Convert(c).(color.Gray16).Y
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return lums[order[i]] < lums[order[j]]
+	})
+
+	chars := make([]rune, len(pal))
+	for rank, i := range order {
+		if len(pal) == 1 {
+			chars[i] = charset[0]
+			continue
+		}
+		// Round to the nearest character
+		chars[i] = charset[(rank*(len(charset)-1)+(len(pal)-1)/2)/(len(pal)-1)]
+	}
+	return chars
+}
+
+// encodeText writes the dithered image as text, with one character for each
+// pixel and a newline at the end of each row. The characters come from the
+// dithering palette, so the same text is written no matter what the recolor
+// palette is.
+func encodeText(w io.Writer, img image.Image) error {
+	chars := paletteChars(palette)
+	outPalette := color.Palette(outputPalette())
+
+	bw := bufio.NewWriter(w)
+	b := img.Bounds()
+	p, isPaletted := img.(*image.Paletted)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			var i int
+			if isPaletted {
+				i = int(p.ColorIndexAt(x, y))
+			} else {
+				// All the image colors are already palette colors
+				i = outPalette.Index(img.At(x, y))
+			}
+			bw.WriteRune(chars[i])
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
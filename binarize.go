@@ -0,0 +1,99 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// binarizeMethod is an adaptive thresholding algorithm, which calculates a
+// threshold for each pixel from the mean and standard deviation of the pixels
+// in the window around it.
+type binarizeMethod func(mean, stddev, k float64) float64
+
+var binarizeMethods = map[string]binarizeMethod{
+	// https://en.wikipedia.org/wiki/Thresholding_(image_processing)
+	"sauvola": func(mean, stddev, k float64) float64 {
+		// 128 is the dynamic range of the standard deviation, for 8-bit images
+		return mean * (1 + k*(stddev/128-1))
+	},
+	"niblack": func(mean, stddev, k float64) float64 {
+		return mean + k*stddev
+	},
+}
+
+// binarize applies adaptive thresholding to the image. Each pixel becomes the
+// darkest or lightest color of the palette, depending on whether it's below or
+// above the threshold for its window. The window is a square with sides of
+// length window, centered on the pixel.
+//
+// The returned image uses the provided palette, in the same order.
+func binarize(img image.Image, pal []color.Color, method binarizeMethod, window int, k float64) *image.Paletted {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// Find the darkest and lightest palette colors
+	dark, light := 0, 0
+	lums := make([]uint8, len(pal))
+	for i, c := range pal {
+		lums[i] = color.GrayModel.Convert(c).(color.Gray).Y
+		if lums[i] < lums[dark] {
+			dark = i
+		}
+		if lums[i] > lums[light] {
+			light = i
+		}
+	}
+
+	// Integral images of the gray values and their squares, so the mean and
+	// standard deviation of any window can be found quickly.
+	// They have an extra row and column of zeros at the start.
+	sum := make([]float64, (w+1)*(h+1))
+	sqSum := make([]float64, (w+1)*(h+1))
+	gray := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		rowSum, rowSqSum := 0.0, 0.0
+		for x := 0; x < w; x++ {
+			v := float64(color.GrayModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.Gray).Y)
+			gray[y*w+x] = v
+			rowSum += v
+			rowSqSum += v * v
+			sum[(y+1)*(w+1)+x+1] = sum[y*(w+1)+x+1] + rowSum
+			sqSum[(y+1)*(w+1)+x+1] = sqSum[y*(w+1)+x+1] + rowSqSum
+		}
+	}
+	area := func(s []float64, x0, y0, x1, y1 int) float64 {
+		return s[y1*(w+1)+x1] - s[y0*(w+1)+x1] - s[y1*(w+1)+x0] + s[y0*(w+1)+x0]
+	}
+
+	// Each image gets its own palette, because recoloring changes it in place
+	p := image.NewPaletted(b, append(color.Palette(nil), pal...))
+	half := window / 2
+	clamp := func(v, max int) int {
+		if v < 0 {
+			return 0
+		}
+		if v > max {
+			return max
+		}
+		return v
+	}
+	for y := 0; y < h; y++ {
+		y0, y1 := clamp(y-half, h), clamp(y+half+1, h)
+		for x := 0; x < w; x++ {
+			x0, x1 := clamp(x-half, w), clamp(x+half+1, w)
+
+			n := float64((x1 - x0) * (y1 - y0))
+			mean := area(sum, x0, y0, x1, y1) / n
+			variance := area(sqSum, x0, y0, x1, y1)/n - mean*mean
+			stddev := math.Sqrt(math.Max(variance, 0))
+
+			if gray[y*w+x] > method(mean, stddev, k) {
+				p.Pix[y*p.Stride+x] = uint8(light)
+			} else {
+				p.Pix[y*p.Stride+x] = uint8(dark)
+			}
+		}
+	}
+	return p
+}
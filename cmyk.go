@@ -0,0 +1,74 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/makeworld-the-better-one/dither/v2"
+)
+
+// cmykInks are the names of the CMYK channels, used in output file names.
+var cmykInks = [4]string{"cyan", "magenta", "yellow", "black"}
+
+// cmykSeparations converts the image to CMYK and dithers each channel with
+// the ordered dither matrix, rotated by that channel's screen angle in
+// degrees. Each returned image is black where its ink is printed, and white
+// where it isn't, in the order of cmykInks.
+//
+// The conversion is the simple one with full black replacement, where black
+// is 1 - max(R, G, B), and it isn't color-managed. Transparent pixels are left
+// as paper.
+func cmykSeparations(img image.Image, matrix dither.OrderedDitherMatrix, strength float32, angles [4]float64) [4]*image.Paletted {
+	b := img.Bounds()
+	mapper := dither.PixelMapperFromMatrix(matrix, strength)
+	mh, mw := len(matrix.Matrix), len(matrix.Matrix[0])
+
+	var sins, coss [4]float64
+	var planes [4]*image.Paletted
+	for i := range planes {
+		planes[i] = image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), separationPalette)
+		sins[i], coss[i] = math.Sincos(angles[i] * math.Pi / 180)
+	}
+
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			c := color.NRGBA64Model.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA64)
+			if c.A == 0 {
+				continue
+			}
+			inks := rgbToCMYK(float64(c.R)/0xffff, float64(c.G)/0xffff, float64(c.B)/0xffff)
+			for i, ink := range inks {
+				// Position in the rotated screen, wrapped to the matrix
+				u := int(math.Floor(float64(x)*coss[i] + float64(y)*sins[i]))
+				v := int(math.Floor(float64(y)*coss[i] - float64(x)*sins[i]))
+				u = (u%mw + mw) % mw
+				v = (v%mh + mh) % mh
+
+				// Ink coverage is dithered directly, not in linear light, so
+				// the area covered by ink matches the amount of ink
+				paper := uint16(math.Round((1 - ink) * 0xffff))
+				mapped, _, _ := mapper(u, v, paper, paper, paper)
+				if mapped < 0x8000 {
+					planes[i].SetColorIndex(x, y, 1)
+				}
+			}
+		}
+	}
+	return planes
+}
+
+// rgbToCMYK converts sRGB values in the range [0, 1] to CMYK, with full black
+// replacement.
+func rgbToCMYK(r, g, b float64) [4]float64 {
+	k := 1 - math.Max(r, math.Max(g, b))
+	if k == 1 {
+		return [4]float64{0, 0, 0, 1}
+	}
+	return [4]float64{
+		(1 - r - k) / (1 - k),
+		(1 - g - k) / (1 - k),
+		(1 - b - k) / (1 - k),
+		k,
+	}
+}
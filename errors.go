@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Exit codes, so scripts can tell what kind of error happened
+const (
+	exitError       = 1 // Anything else, like a failure while dithering
+	exitUsage       = 2 // Bad flags, flag values, or command arguments
+	exitIO          = 3 // A file couldn't be read or written
+	exitUnsupported = 4 // An input or output format isn't supported
+)
+
+// usageError is an error caused by how didder was run, like a bad flag value.
+type usageError struct{ err error }
+
+func (e usageError) Error() string { return e.err.Error() }
+func (e usageError) Unwrap() error { return e.err }
+
+// formatError is an error caused by a file format that isn't supported.
+type formatError struct{ err error }
+
+func (e formatError) Error() string { return e.err.Error() }
+func (e formatError) Unwrap() error { return e.err }
+
+// summaryError lists several problems in its message, and wraps the first of
+// them so exitCode can tell what kind of error it is.
+type summaryError struct {
+	msg string
+	err error
+}
+
+func (e summaryError) Error() string { return e.msg }
+func (e summaryError) Unwrap() error { return e.err }
+
+// inputLoaded is set once an input image starts being loaded, after
+// preProcess. Errors that happen before then are about the flags and
+// arguments, so they're usage errors, unless they're about files or formats.
+var inputLoaded bool
+
+// exitCode returns the exit code for the error.
+func exitCode(err error) int {
+	var fe formatError
+	var pe *fs.PathError
+	var ue usageError
+	switch {
+	case errors.As(err, &fe) || errors.Is(err, image.ErrFormat):
+		return exitUnsupported
+	case errors.As(err, &pe) || errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) ||
+		errors.Is(err, fs.ErrExist):
+		return exitIO
+	case errors.As(err, &ue):
+		return exitUsage
+	}
+	return exitError
+}
+
+// withUsageErrors wraps the errors that f returns as usage errors, as long as
+// no input image was loaded yet.
+func withUsageErrors(f func(c *cli.Context) error) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		err := f(c)
+		if err != nil && !inputLoaded {
+			return usageError{err}
+		}
+		return err
+	}
+}
+
+// onUsageError is used for errors parsing flags. It shows the help like the
+// cli package would, and makes the error a usage error.
+func onUsageError(c *cli.Context, err error, isSubcommand bool) error {
+	if c.Command != nil {
+		fmt.Fprintln(c.App.Writer, "Incorrect Usage:", err.Error())
+		fmt.Fprintln(c.App.Writer)
+		_ = cli.ShowCommandHelp(c, c.Command.Name)
+	} else {
+		fmt.Fprintf(c.App.Writer, "Incorrect Usage. %s\n\n", err.Error())
+		_ = cli.ShowAppHelp(c)
+	}
+	return usageError{err}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// outputFormat describes a supported output format.
+type outputFormat struct {
+	name string
+	// ext is the file extension without a dot, if it's not the same as name
+	ext          string
+	animation    bool
+	transparency bool
+	desc         string
+}
+
+// outputFormats lists the supported output formats, in the order they're
+// listed in error messages and by --list-formats.
+var outputFormats = []outputFormat{
+	{name: "png", transparency: true, desc: "PNG image"},
+	{name: "gif", animation: true, transparency: true, desc: "GIF image, animated when there are multiple input images"},
+	{name: "txt", desc: "ASCII art"},
+	{name: "raw", desc: "palette indexes with no container, for framebuffers"},
+	{name: "carray", ext: "h", desc: "C header with the palette indexes as an array"},
+}
+
+// formatExt returns the file extension for an output format, without a dot.
+func formatExt(format string) string {
+	for _, f := range outputFormats {
+		if f.name == format && f.ext != "" {
+			return f.ext
+		}
+	}
+	return format
+}
+
+// extFormat returns the output format for a file extension without a dot.
+// If it's not a known extension, it's returned as is.
+func extFormat(ext string) string {
+	for _, f := range outputFormats {
+		if f.ext == ext {
+			return f.name
+		}
+	}
+	return ext
+}
+
+// isFormat returns true if the output format is supported.
+func isFormat(format string) bool {
+	for _, f := range outputFormats {
+		if f.name == format {
+			return true
+		}
+	}
+	return false
+}
+
+// listFormats prints the supported output formats, with their file extension
+// and whether they support animation and transparency.
+func listFormats() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FORMAT\tEXTENSION\tANIMATION\tTRANSPARENCY\tDESCRIPTION")
+	yesNo := map[bool]string{true: "yes", false: "no"}
+	for _, f := range outputFormats {
+		fmt.Fprintf(w, "%s\t.%s\t%s\t%s\t%s\n", f.name, formatExt(f.name), yesNo[f.animation], yesNo[f.transparency], f.desc)
+	}
+	w.Flush()
+}
+
+// unsupportedFormat returns an error for an output format that isn't supported.
+func unsupportedFormat(format string) error {
+	quoted := make([]string, len(outputFormats))
+	for i, f := range outputFormats {
+		quoted[i] = "'" + f.name + "'"
+	}
+	return formatError{fmt.Errorf(
+		"'%s' is an unsupported format, only %s, or %s are accepted",
+		format, strings.Join(quoted[:len(quoted)-1], ", "), quoted[len(quoted)-1],
+	)}
+}
+
+// maxColors returns the most palette colors the output format can store with
+// the current flags, and a description of the limit for errors. It returns 0
+// if there's no limit.
+func maxColors(format string) (int, string) {
+	switch format {
+	case "gif":
+		return 256 - gifReserved, "GIF output"
+	case "png":
+		if pngBitDepth != 0 {
+			return 1 << pngBitDepth, fmt.Sprintf("PNG output with a bit depth of %d", pngBitDepth)
+		}
+		if indexed {
+			return 256, "indexed PNG output"
+		}
+	case "raw", "carray":
+		return 1 << rawBits, fmt.Sprintf("%s output with --bits-per-pixel %d", format, rawBits)
+	}
+	return 0, ""
+}
+
+// checkFormats returns an error if a palette of n colors can't be stored in
+// one of the output formats. It's called by preProcess, so that errors happen
+// before any images are dithered.
+func checkFormats(formats []string, n int) error {
+	for _, format := range formats {
+		max, desc := maxColors(format)
+		if max != 0 && n > max {
+			return fmt.Errorf("%s only supports %d colors or less in the palette", desc, max)
+		}
+	}
+	return nil
+}
+
+// parseCompression parses the --compression flag, which is a type like
+// "speed" or a level from 0 to 9 like zlib uses. The PNG encoder only has a
+// few levels, so numbers are mapped to the closest one.
+func parseCompression(arg string) (png.CompressionLevel, error) {
+	switch arg {
+	case "default":
+		return png.DefaultCompression, nil
+	case "no":
+		return png.NoCompression, nil
+	case "speed":
+		return png.BestSpeed, nil
+	case "size":
+		return png.BestCompression, nil
+	}
+	level, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, fmt.Errorf("invalid compression type '%s'", arg)
+	}
+	switch {
+	case level < 0 || level > 9:
+		return 0, fmt.Errorf("compression level %d is out of range, it must be from 0 to 9", level)
+	case level == 0:
+		return png.NoCompression, nil
+	case level <= 3:
+		return png.BestSpeed, nil
+	case level <= 6:
+		return png.DefaultCompression, nil
+	}
+	return png.BestCompression, nil
+}
+
+// gifReserved is the number of GIF palette entries that are kept after the
+// palette colors. They're fully transparent, and set by --keep-transparency
+// for the pixels that are transparent in the input image. Images dithered by
+// ditherPaletted always end with these entries, and the GIF encoder is given
+// this many more colors than the palette has.
+var gifReserved int
+
+// gifPalette returns a copy of the palette for the GIF encoder, with the
+// reserved entries added to the end.
+func gifPalette(pal []color.Color) color.Palette {
+	gp := make(color.Palette, len(pal), len(pal)+gifReserved)
+	copy(gp, pal)
+	for i := 0; i < gifReserved; i++ {
+		gp = append(gp, color.NRGBA{})
+	}
+	return gp
+}
+
+// withGIFPalette returns the dithered image with the reserved GIF entries
+// added to its palette, and the pixels that are fully transparent in src set
+// to the first of them.
+func withGIFPalette(p *image.Paletted, src image.Image) *image.Paletted {
+	if gifReserved == 0 {
+		return p
+	}
+	n := len(p.Palette)
+	p.Palette = gifPalette(p.Palette)
+	b := p.Bounds()
+	sb := src.Bounds()
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			if _, _, _, a := src.At(sb.Min.X+x, sb.Min.Y+y).RGBA(); a == 0 {
+				p.Pix[y*p.Stride+x] = uint8(n)
+			}
+		}
+	}
+	return p
+}
+
+// ditheredPalette returns the palette colors of an image made by
+// ditherPaletted, without the reserved GIF entries.
+func ditheredPalette(p *image.Paletted) color.Palette {
+	return p.Palette[:len(p.Palette)-gifReserved]
+}
+
+// packPixels returns the palette index of each pixel, packed into bytes with
+// rawBits bits each, most significant bits first. Each row starts on a new
+// byte.
+func packPixels(img image.Image) []byte {
+	p := padPalette(img, 0)
+	b := p.Bounds()
+
+	perByte := 8 / rawBits
+	rowLen := (b.Dx() + perByte - 1) / perByte
+	packed := make([]byte, rowLen*b.Dy())
+	for y := 0; y < b.Dy(); y++ {
+		row := packed[y*rowLen : (y+1)*rowLen]
+		pix := p.Pix[y*p.Stride : y*p.Stride+b.Dx()]
+		for x, index := range pix {
+			shift := 8 - rawBits*(x%perByte+1)
+			row[x/perByte] |= index << shift
+		}
+	}
+	return packed
+}
+
+// encodeRaw writes the packed pixels, with no container format. If rawHeader
+// is set, the width and height are written first as 16-bit little-endian
+// integers.
+func encodeRaw(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+
+	bw := bufio.NewWriter(w)
+	if rawHeader {
+		if b.Dx() > 0xffff || b.Dy() > 0xffff {
+			return errors.New("image is too big for the raw header, which stores sizes up to 65535")
+		}
+		binary.Write(bw, binary.LittleEndian, [2]uint16{uint16(b.Dx()), uint16(b.Dy())})
+	}
+	bw.Write(packPixels(img))
+	return bw.Flush()
+}
+
+// cIdentifier matches valid C identifiers, for --var-name.
+var cIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// encodeCArray writes the packed pixels as a C header file, with the array
+// named varName and defines for the width and height.
+func encodeCArray(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	upper := strings.ToUpper(varName)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "// Generated by didder\n// Bits per pixel: %d\n\n", rawBits)
+	fmt.Fprintf(bw, "#include <stdint.h>\n\n")
+	fmt.Fprintf(bw, "#define %s_WIDTH %d\n", upper, b.Dx())
+	fmt.Fprintf(bw, "#define %s_HEIGHT %d\n\n", upper, b.Dy())
+	fmt.Fprintf(bw, "const uint8_t %s[] = {", varName)
+	for i, v := range packPixels(img) {
+		if i%12 == 0 {
+			bw.WriteString("\n   ")
+		}
+		fmt.Fprintf(bw, " 0x%02x,", v)
+	}
+	bw.WriteString("\n};\n")
+	return bw.Flush()
+}
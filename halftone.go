@@ -0,0 +1,104 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// halftoneSamples is the number of samples per side used to build the
+// threshold table for the spot function.
+const halftoneSamples = 64
+
+// spotThresholds returns the spot function values at evenly spaced points
+// across one halftone cell, sorted. The rank of a spot value in this list is
+// the fraction of the cell that is covered by the dot when it reaches that
+// value, which makes dot area proportional to tone.
+func spotThresholds() []float64 {
+	vals := make([]float64, 0, halftoneSamples*halftoneSamples)
+	for y := 0; y < halftoneSamples; y++ {
+		for x := 0; x < halftoneSamples; x++ {
+			u := (float64(x)+0.5)/halftoneSamples - 0.5
+			v := (float64(y)+0.5)/halftoneSamples - 0.5
+			vals = append(vals, spot(u, v))
+		}
+	}
+	sort.Float64s(vals)
+	return vals
+}
+
+// spot is the round (Euclidean) dot spot function. u and v are the position
+// in the cell, in the range -0.5 to 0.5. Higher values are inked first, so
+// dots grow from the center of the cell. In dark tones the dots join up and
+// become white holes, at the corners of the cell.
+func spot(u, v float64) float64 {
+	return (math.Cos(2*math.Pi*u) + math.Cos(2*math.Pi*v)) / 2
+}
+
+// halftone renders the image as a halftone screen of dots, where the size of
+// each dot depends on the tone of the image under it. cell is the size of one
+// halftone cell in pixels, and angle is the screen angle in degrees.
+//
+// The image is halftoned in luminance. The palette colors are ordered from
+// darkest to lightest, and each pixel is a dot between the two colors that its
+// tone falls between, so palettes with more than two colors give multi-level
+// halftones.
+//
+// The returned image uses the provided palette, in the same order.
+func halftone(img image.Image, pal []color.Color, cell, angle float64) *image.Paletted {
+	b := img.Bounds()
+
+	// Palette indexes sorted from darkest to lightest, with their luminance
+	order := make([]int, len(pal))
+	lums := make([]float64, len(pal))
+	for i, c := range pal {
+		order[i] = i
+		lums[i] = float64(color.Gray16Model.Convert(c).(color.Gray16).Y) / 0xffff
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return lums[order[i]] < lums[order[j]]
+	})
+
+	thresholds := spotThresholds()
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+
+	// The palette is copied, because recoloring changes it in place
+	p := image.NewPaletted(b, append(color.Palette(nil), pal...))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			lum := float64(color.Gray16Model.Convert(img.At(x, y)).(color.Gray16).Y) / 0xffff
+
+			// Find the darker and lighter palette colors around the tone
+			k := 0
+			for k < len(order)-2 && lum > lums[order[k+1]] {
+				k++
+			}
+			dark, light := order[k], order[k+1]
+			var coverage float64 // Fraction of the cell covered by the dark color
+			if span := lums[light] - lums[dark]; span > 0 {
+				coverage = (lums[light] - lum) / span
+			} else if lum <= lums[dark] {
+				coverage = 1
+			}
+
+			// Position in the rotated cell, from -0.5 to 0.5
+			fx, fy := (float64(x-b.Min.X)+0.5)/cell, (float64(y-b.Min.Y)+0.5)/cell
+			u := fx*cos + fy*sin
+			v := -fx*sin + fy*cos
+			u -= math.Floor(u) + 0.5
+			v -= math.Floor(v) + 0.5
+
+			// Rank of this point in the cell, from 0 (inked first) to 1
+			s := spot(u, v)
+			rank := 1 - float64(sort.SearchFloat64s(thresholds, s))/float64(len(thresholds))
+
+			if rank < coverage {
+				p.Pix[p.PixOffset(x, y)] = uint8(dark)
+			} else {
+				p.Pix[p.PixOffset(x, y)] = uint8(light)
+			}
+		}
+	}
+	return p
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/disintegration/imaging"
+	"github.com/makeworld-the-better-one/didder/pkg/didder"
+	"github.com/makeworld-the-better-one/dither/v2"
+)
+
+// hybridDither dithers the image in two passes. The global pass dithers a
+// copy of the image that's scale times smaller, which is then scaled back up
+// and blurred, so it only carries the overall tone that the global algorithm
+// chose. That tone is mixed into the image by mix, from 0 to 1, and then the
+// local pass dithers the result at full size, which adds the fine texture.
+//
+// This is meant for error diffusion as the global pass and ordered dithering
+// as the local one, so large areas get the tone distribution of error
+// diffusion without its worms, but any algorithms work.
+//
+// The returned image uses the palette of the local Ditherer.
+func hybridDither(img image.Image, global, local *dither.Ditherer, scale int, mix float64) *image.Paletted {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	sw, sh := w/scale, h/scale
+	if sw < 1 {
+		sw = 1
+	}
+	if sh < 1 {
+		sh = 1
+	}
+	small := didder.DitherWith(global, imaging.Resize(img, sw, sh, imaging.Box))
+	tone := imaging.Blur(imaging.Resize(small, w, h, imaging.Linear), float64(scale)/2)
+
+	mixed := image.NewNRGBA64(b)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA64Model.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA64)
+			t := tone.NRGBAAt(x, y)
+			mixed.SetNRGBA64(b.Min.X+x, b.Min.Y+y, color.NRGBA64{
+				R: mixChannel(c.R, t.R, mix),
+				G: mixChannel(c.G, t.G, mix),
+				B: mixChannel(c.B, t.B, mix),
+				// Transparency always comes from the original
+				A: c.A,
+			})
+		}
+	}
+
+	p := image.NewPaletted(b, local.GetPalette())
+	copyImage(p, didder.DitherWith(local, mixed))
+	return p
+}
+
+// mixChannel mixes a 16-bit channel value with an 8-bit one, by mix.
+func mixChannel(v uint16, t uint8, mix float64) uint16 {
+	return uint16(float64(v)*(1-mix) + float64(uint16(t)*0x101)*mix + 0.5)
+}
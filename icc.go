@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+
+	"github.com/disintegration/imaging"
+)
+
+// colorManaged is set by --color-managed, to convert input images with an
+// embedded ICC profile to sRGB.
+var colorManaged bool
+
+// xyzToLinearSRGB converts CIE XYZ, relative to the D50 white point that ICC
+// profiles use, to linear sRGB. It's the inverse of the Bradford-adapted sRGB
+// matrix.
+var xyzToLinearSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// iccTransform converts colors from an RGB ICC profile to sRGB.
+type iccTransform struct {
+	// trc holds the linear value of each 16-bit channel value, per channel
+	trc [3][]float64
+	// matrix converts linear RGB of the profile to linear sRGB
+	matrix [3][3]float64
+}
+
+// loadManagedImage decodes an input image like loadImage, and converts it to
+// sRGB using its embedded ICC profile, if it has one.
+func loadManagedImage(arg string) (image.Image, error) {
+	// The profile comes before the pixel data in both PNG and JPEG files, so
+	// the bytes read by the decoder always include it
+	var header bytes.Buffer
+	var img image.Image
+	var err error
+	if arg == "-" {
+		img, err = decodeStdin(io.TeeReader(os.Stdin, &header))
+	} else {
+		var f *os.File
+		f, err = os.Open(arg)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		img, err = imaging.Decode(io.TeeReader(f, &header), autoOrientation)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := embeddedProfile(header.Bytes())
+	if err != nil {
+		warn("couldn't read ICC profile of '%s', assuming sRGB: %v", arg, err)
+		return img, nil
+	}
+	if profile == nil {
+		// No profile, so it's sRGB
+		return img, nil
+	}
+	t, err := parseICC(profile)
+	if err != nil {
+		warn("ICC profile of '%s' isn't supported, assuming sRGB: %v", arg, err)
+		return img, nil
+	}
+	return t.apply(img), nil
+}
+
+// embeddedProfile returns the ICC profile embedded in PNG or JPEG file data,
+// or nil if there isn't one.
+func embeddedProfile(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return pngProfile(data[8:])
+	}
+	if bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return jpegProfile(data[2:])
+	}
+	return nil, nil
+}
+
+// pngProfile returns the profile in the iCCP chunk of PNG data, after the
+// signature.
+func pngProfile(data []byte) ([]byte, error) {
+	for len(data) >= 8 {
+		length := int(binary.BigEndian.Uint32(data))
+		typ := string(data[4:8])
+		if length < 0 || 8+length > len(data) {
+			return nil, nil
+		}
+		chunk := data[8 : 8+length]
+		switch typ {
+		case "iCCP":
+			// Profile name, null separator, compression method, then the
+			// compressed profile
+			i := bytes.IndexByte(chunk, 0)
+			if i == -1 || i+2 > len(chunk) {
+				return nil, errors.New("invalid iCCP chunk")
+			}
+			r, err := zlib.NewReader(bytes.NewReader(chunk[i+2:]))
+			if err != nil {
+				return nil, err
+			}
+			return io.ReadAll(r)
+		case "IDAT", "IEND":
+			return nil, nil
+		}
+		// Skip the data and CRC
+		if 12+length > len(data) {
+			return nil, nil
+		}
+		data = data[12+length:]
+	}
+	return nil, nil
+}
+
+// jpegProfile returns the profile in the APP2 segments of JPEG data, after
+// the SOI marker. Large profiles are split across several segments.
+func jpegProfile(data []byte) ([]byte, error) {
+	marker := []byte("ICC_PROFILE\x00")
+	var chunks [][]byte
+	for len(data) >= 4 && data[0] == 0xff {
+		kind := data[1]
+		if kind == 0xda || kind == 0xd9 {
+			// Start of scan or end of image, there are no more headers
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if length < 2 || 2+length > len(data) {
+			break
+		}
+		segment := data[4 : 2+length]
+		if kind == 0xe2 && bytes.HasPrefix(segment, marker) && len(segment) >= len(marker)+2 {
+			// Sequence number (from 1) and count, then the data
+			seq := int(segment[len(marker)])
+			count := int(segment[len(marker)+1])
+			if chunks == nil {
+				chunks = make([][]byte, count)
+			}
+			if seq < 1 || seq > len(chunks) {
+				return nil, errors.New("invalid ICC_PROFILE segment")
+			}
+			chunks[seq-1] = segment[len(marker)+2:]
+		}
+		data = data[2+length:]
+	}
+	if chunks == nil {
+		return nil, nil
+	}
+	var profile []byte
+	for _, chunk := range chunks {
+		if chunk == nil {
+			return nil, errors.New("ICC profile is missing a segment")
+		}
+		profile = append(profile, chunk...)
+	}
+	return profile, nil
+}
+
+// parseICC reads an RGB ICC profile that uses colorant and tone curve tags,
+// which most display and camera profiles like Display P3 and Adobe RGB do.
+// Profiles that only have lookup tables aren't supported.
+func parseICC(profile []byte) (*iccTransform, error) {
+	if len(profile) < 132 {
+		return nil, errors.New("profile is too short")
+	}
+	if space := string(profile[16:20]); space != "RGB " {
+		return nil, fmt.Errorf("color space is '%s', not RGB", bytes.TrimSpace([]byte(space)))
+	}
+
+	// Tag table
+	tags := make(map[string][]byte)
+	n := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < n; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(profile) {
+			return nil, errors.New("tag table is truncated")
+		}
+		offset := int(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			return nil, errors.New("tag is outside of the profile")
+		}
+		tags[string(profile[entry:entry+4])] = profile[offset : offset+size]
+	}
+
+	var t iccTransform
+	var colorants [3][3]float64
+	for ch, prefix := range []string{"r", "g", "b"} {
+		xyz, ok := tags[prefix+"XYZ"]
+		if !ok || len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, errors.New("no colorant tags")
+		}
+		for i := 0; i < 3; i++ {
+			colorants[i][ch] = s15Fixed16(xyz[8+i*4:])
+		}
+
+		curve, ok := tags[prefix+"TRC"]
+		if !ok {
+			return nil, errors.New("no tone curve tags")
+		}
+		lut, err := parseTRC(curve)
+		if err != nil {
+			return nil, err
+		}
+		t.trc[ch] = lut
+	}
+
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				t.matrix[i][j] += xyzToLinearSRGB[i][k] * colorants[k][j]
+			}
+		}
+	}
+	return &t, nil
+}
+
+// s15Fixed16 reads an ICC signed 15.16 fixed point number.
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// parseTRC reads a 'curv' or 'para' tone curve tag, and returns the linear
+// value for every 16-bit channel value.
+func parseTRC(tag []byte) ([]float64, error) {
+	if len(tag) < 12 {
+		return nil, errors.New("tone curve is too short")
+	}
+
+	var f func(x float64) float64
+	switch string(tag[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case count == 0:
+			f = func(x float64) float64 { return x }
+		case count == 1:
+			if len(tag) < 14 {
+				return nil, errors.New("tone curve is truncated")
+			}
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			f = func(x float64) float64 { return math.Pow(x, gamma) }
+		default:
+			if len(tag) < 12+count*2 {
+				return nil, errors.New("tone curve is truncated")
+			}
+			table := make([]float64, count)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(tag[12+i*2:])) / 0xffff
+			}
+			f = func(x float64) float64 {
+				// Linear interpolation between table entries
+				pos := x * float64(count-1)
+				i := int(pos)
+				if i >= count-1 {
+					return table[count-1]
+				}
+				frac := pos - float64(i)
+				return table[i]*(1-frac) + table[i+1]*frac
+			}
+		}
+	case "para":
+		kind := binary.BigEndian.Uint16(tag[8:])
+		nParams := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}[kind]
+		if nParams == 0 {
+			return nil, fmt.Errorf("unknown parametric curve type %d", kind)
+		}
+		if len(tag) < 12+nParams*4 {
+			return nil, errors.New("parametric curve is truncated")
+		}
+		var p [7]float64
+		for i := 0; i < nParams; i++ {
+			p[i] = s15Fixed16(tag[12+i*4:])
+		}
+		g, a, b, c, d, e, ff := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		f = func(x float64) float64 {
+			switch kind {
+			case 0:
+				return math.Pow(x, g)
+			case 1:
+				if x >= -b/a {
+					return math.Pow(a*x+b, g)
+				}
+				return 0
+			case 2:
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			case 3:
+				if x >= d {
+					return math.Pow(a*x+b, g)
+				}
+				return c * x
+			default:
+				if x >= d {
+					return math.Pow(a*x+b, g) + e
+				}
+				return c*x + ff
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown tone curve type '%s'", tag[:4])
+	}
+
+	lut := make([]float64, 65536)
+	for i := range lut {
+		lut[i] = f(float64(i) / 0xffff)
+	}
+	return lut, nil
+}
+
+// apply returns a copy of the image converted to sRGB. Colors outside of
+// sRGB are clipped.
+func (t *iccTransform) apply(img image.Image) *image.NRGBA64 {
+	b := img.Bounds()
+	dst := image.NewNRGBA64(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			lin := [3]float64{t.trc[0][c.R], t.trc[1][c.G], t.trc[2][c.B]}
+			var out [3]uint16
+			for i := range out {
+				v := t.matrix[i][0]*lin[0] + t.matrix[i][1]*lin[1] + t.matrix[i][2]*lin[2]
+				out[i] = uint16(delinearize(math.Max(0, math.Min(1, v)))*0xffff + 0.5)
+			}
+			dst.SetNRGBA64(x, y, color.NRGBA64{out[0], out[1], out[2], c.A})
+		}
+	}
+	return dst
+}
@@ -15,9 +15,11 @@ var (
 	builtBy = "unknown"
 )
 
-func main() {
-
-	app := &cli.App{
+// newApp returns the didder app, with all its flags and commands. cli keeps
+// parsed flag values in the flags themselves, so each parse of the args needs
+// a new app.
+func newApp() *cli.App {
+	return &cli.App{
 		Name:                   "didder",
 		Usage:                  "dither images with a variety of algorithms and processing options.",
 		Description:            "didder dithers images.\n\nRun `man didder` for more information, or view the manual online:\nhttps://github.com/makeworld-the-better-one/didder/blob/main/MANPAGE.md",
@@ -27,19 +29,66 @@ func main() {
 				Name:    "strength",
 				Aliases: []string{"s"},
 			},
+			&cli.StringFlag{
+				Name: "strength-r",
+			},
+			&cli.StringFlag{
+				Name: "strength-g",
+			},
+			&cli.StringFlag{
+				Name: "strength-b",
+			},
+			&cli.StringFlag{
+				Name: "strength-file",
+			},
+			&cli.BoolFlag{
+				Name: "serpentine",
+			},
+			&cli.Int64Flag{
+				Name: "seed",
+			},
+			&cli.BoolFlag{
+				Name: "deterministic",
+			},
 			&cli.UintFlag{
 				Name:    "threads",
 				Aliases: []string{"j"},
 			},
+			&cli.BoolFlag{
+				Name: "preflight",
+			},
+			&cli.BoolFlag{
+				Name: "keep-going",
+			},
 			&cli.StringFlag{
-				Name:     "palette",
-				Aliases:  []string{"p"},
-				Required: true,
+				Name: "json-report",
+			},
+			&cli.BoolFlag{
+				Name: "report-usage",
+			},
+			&cli.StringFlag{
+				Name: "separations",
+			},
+			&cli.StringFlag{
+				Name: "manifest",
+			},
+			&cli.StringFlag{
+				Name:    "palette",
+				Aliases: []string{"p"},
 			},
 			&cli.BoolFlag{
 				Name:    "grayscale",
 				Aliases: []string{"g"},
 			},
+			&cli.StringFlag{
+				Name: "grayscale-method",
+			},
+			&cli.BoolFlag{
+				Name: "invert",
+			},
+			&cli.StringFlag{
+				Name: "sepia",
+			},
 			&cli.StringFlag{
 				Name: "saturation",
 			},
@@ -49,27 +98,103 @@ func main() {
 			&cli.StringFlag{
 				Name: "contrast",
 			},
+			&cli.StringFlag{
+				Name: "thresholds",
+			},
+			&cli.BoolFlag{
+				Name: "auto-contrast",
+			},
 			&cli.StringFlag{
 				Name:    "recolor",
 				Aliases: []string{"r"},
 			},
+			&cli.StringFlag{
+				Name: "recolor-map",
+			},
+			&cli.BoolFlag{
+				Name: "recolor-keep-alpha",
+			},
+			&cli.StringFlag{
+				Name: "gradient-map",
+			},
+			&cli.UintFlag{
+				Name:  "sample-colors",
+				Value: 16,
+			},
+			&cli.BoolFlag{
+				Name: "per-image-palette",
+			},
+			&cli.BoolFlag{
+				Name: "invert-palette",
+			},
+			&cli.BoolFlag{
+				Name: "dedup-palette",
+			},
+			&cli.StringFlag{
+				Name:  "sort-palette",
+				Value: "none",
+			},
+			&cli.StringFlag{
+				Name: "export-palette",
+			},
+			&cli.StringFlag{
+				Name:  "ramp-space",
+				Value: "srgb",
+			},
+			&cli.BoolFlag{
+				Name: "linear",
+			},
 			&cli.BoolFlag{
 				Name: "no-exif-rotation",
 			},
+			&cli.BoolFlag{
+				Name: "color-managed",
+			},
 			&cli.StringFlag{
 				Name:    "format",
 				Aliases: []string{"f"},
 				Value:   "png",
 			},
 			&cli.StringFlag{
-				Name:     "out",
-				Aliases:  []string{"o"},
-				Required: true,
+				Name:  "charset",
+				Value: defaultCharset,
+			},
+			&cli.StringFlag{
+				Name:    "out",
+				Aliases: []string{"o"},
+			},
+			&cli.BoolFlag{
+				Name: "number",
+			},
+			&cli.BoolFlag{
+				Name: "preview",
+			},
+			&cli.BoolFlag{
+				Name: "preview-open",
 			},
 			&cli.StringSliceFlag{
-				Name:     "in",
-				Aliases:  []string{"i"},
-				Required: true,
+				Name:    "in",
+				Aliases: []string{"i"},
+			},
+			&cli.StringFlag{
+				Name: "input-raw",
+			},
+			&cli.StringFlag{
+				Name:  "input-raw-format",
+				Value: "rgb",
+			},
+			&cli.StringFlag{
+				Name:  "sort",
+				Value: "natural",
+			},
+			&cli.BoolFlag{
+				Name: "no-sort",
+			},
+			&cli.StringFlag{
+				Name: "frames",
+			},
+			&cli.StringSliceFlag{
+				Name: "also-format",
 			},
 			&cli.BoolFlag{
 				Name: "no-overwrite",
@@ -79,9 +204,41 @@ func main() {
 				Aliases: []string{"c"},
 				Value:   "default",
 			},
+			&cli.StringFlag{
+				Name: "transparent",
+			},
+			&cli.BoolFlag{
+				Name: "keep-transparency",
+			},
+			&cli.BoolFlag{
+				Name: "indexed",
+			},
+			&cli.BoolFlag{
+				Name: "no-index",
+			},
+			&cli.BoolFlag{
+				Name: "png-palette-only",
+			},
+			&cli.UintFlag{
+				Name: "png-bit-depth",
+			},
+			&cli.UintFlag{
+				Name:  "bits-per-pixel",
+				Value: 8,
+			},
+			&cli.BoolFlag{
+				Name: "raw-header",
+			},
+			&cli.StringFlag{
+				Name:  "var-name",
+				Value: "image_data",
+			},
 			&cli.Float64Flag{
 				Name: "fps",
 			},
+			&cli.StringFlag{
+				Name: "disposal",
+			},
 			&cli.UintFlag{
 				Name:    "loop",
 				Aliases: []string{"l"},
@@ -94,15 +251,63 @@ func main() {
 				Name:    "height",
 				Aliases: []string{"y"},
 			},
-			&cli.UintFlag{
+			&cli.StringFlag{
 				Name:    "upscale",
 				Aliases: []string{"u"},
-				Value:   1,
+				Value:   "1",
+			},
+			&cli.UintFlag{
+				Name: "pixel-size",
+			},
+			&cli.BoolFlag{
+				Name: "match-input-size",
+			},
+			&cli.StringFlag{
+				Name: "sizes",
+			},
+			&cli.StringFlag{
+				Name: "tile",
+			},
+			&cli.BoolFlag{
+				Name: "tile-mirror",
+			},
+			&cli.UintFlag{
+				Name: "pad",
+			},
+			&cli.StringFlag{
+				Name: "pad-color",
+			},
+			&cli.Uint64Flag{
+				Name:  "max-pixels",
+				Value: 100_000_000,
+			},
+			&cli.BoolFlag{
+				Name: "force",
+			},
+			&cli.BoolFlag{
+				Name: "yes",
+			},
+			&cli.BoolFlag{
+				Name: "compare",
+			},
+			&cli.StringFlag{
+				Name: "debug-error",
+			},
+			&cli.StringFlag{
+				// Expanded by expandPreset before the args are parsed, it's
+				// declared here for the help and shell completion
+				Name: "preset",
 			},
 			&cli.BoolFlag{
 				Name:    "version",
 				Aliases: []string{"v"},
 			},
+			&cli.BoolFlag{
+				Name: "list-palettes",
+			},
+			&cli.BoolFlag{
+				Name: "list-formats",
+			},
 		},
 		Commands: []*cli.Command{
 			{
@@ -113,6 +318,11 @@ func main() {
 						Name:    "seed",
 						Aliases: []string{"s"},
 					},
+					&cli.StringFlag{
+						Name:    "distribution",
+						Aliases: []string{"d"},
+						Value:   "uniform",
+					},
 				},
 				UseShortOptionHandling: true,
 				Action:                 random,
@@ -125,8 +335,14 @@ func main() {
 				Action:                 bayer,
 			},
 			{
-				Name:                   "odm",
-				Usage:                  "Ordered Dither Matrix",
+				Name:  "odm",
+				Usage: "Ordered Dither Matrix",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "mask",
+						Aliases: []string{"m"},
+					},
+				},
 				UseShortOptionHandling: true,
 				Action:                 odm,
 			},
@@ -142,11 +358,136 @@ func main() {
 				UseShortOptionHandling: true,
 				Action:                 edm,
 			},
+			{
+				Name:  "binarize",
+				Usage: "adaptive thresholding for text and documents",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "method",
+						Aliases: []string{"m"},
+						Value:   "sauvola",
+					},
+					&cli.UintFlag{
+						Name:    "window",
+						Aliases: []string{"w"},
+						Value:   15,
+					},
+					&cli.Float64Flag{
+						Name:  "k",
+						Value: 0.2,
+					},
+				},
+				UseShortOptionHandling: true,
+				Action:                 binarizeCmd,
+			},
+			{
+				Name:  "halftone",
+				Usage: "newspaper-style halftone dots that grow with the tone",
+				Flags: []cli.Flag{
+					&cli.Float64Flag{
+						Name:  "lpi",
+						Value: 60,
+					},
+					&cli.Float64Flag{
+						Name:  "dpi",
+						Value: 300,
+					},
+					&cli.Float64Flag{
+						Name:    "angle",
+						Aliases: []string{"a"},
+						Value:   45,
+					},
+				},
+				UseShortOptionHandling: true,
+				Action:                 halftoneCmd,
+			},
+			{
+				Name:  "hybrid",
+				Usage: "mix the tone of one algorithm on a smaller copy with the texture of another",
+				Flags: []cli.Flag{
+					&cli.UintFlag{
+						Name:  "scale",
+						Value: 4,
+					},
+					&cli.Float64Flag{
+						Name:    "mix",
+						Aliases: []string{"m"},
+						Value:   0.5,
+					},
+					&cli.BoolFlag{
+						Name:    "serpentine",
+						Aliases: []string{"s"},
+					},
+				},
+				UseShortOptionHandling: true,
+				Action:                 hybridCmd,
+			},
+			{
+				Name:  "cmyk",
+				Usage: "separate into CMYK, and dither each ink with a rotated ordered dither matrix",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "angles",
+						Aliases: []string{"a"},
+						Value:   "15,75,0,45",
+					},
+				},
+				UseShortOptionHandling: true,
+				Action:                 cmykCmd,
+			},
+			{
+				Name:  "montage",
+				Usage: "dither with several algorithms, and lay the results out in a grid",
+				Flags: []cli.Flag{
+					&cli.UintFlag{
+						Name:    "columns",
+						Aliases: []string{"c"},
+					},
+				},
+				UseShortOptionHandling: true,
+				Action:                 montageCmd,
+			},
+			{
+				Name:  "diff",
+				Usage: "dither with two algorithms, and highlight the pixels that differ",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "color",
+						Aliases: []string{"c"},
+						Value:   "red",
+					},
+				},
+				UseShortOptionHandling: true,
+				Action:                 diffCmd,
+			},
+			{
+				Name:                   "sweep",
+				Usage:                  "make an animated GIF with a frame for each algorithm",
+				UseShortOptionHandling: true,
+				Action:                 sweepCmd,
+			},
+			{
+				Name:                   "swatch",
+				Usage:                  "render the palette as an image, without dithering",
+				UseShortOptionHandling: true,
+				Action:                 swatch,
+			},
 		},
-		Before: preProcess,
-		Action: func(c *cli.Context) error {
+		Before:       withUsageErrors(preProcess),
+		OnUsageError: onUsageError,
+		After:        cleanup,
+		Action: withUsageErrors(func(c *cli.Context) error {
 			return errors.New("no command specified")
-		},
+		}),
+	}
+}
+
+func main() {
+	app := newApp()
+
+	for _, cmd := range app.Commands {
+		cmd.Action = withUsageErrors(withPreviewOpen(cmd.Action))
+		cmd.OnUsageError = onUsageError
 	}
 
 	// Handle version flag
@@ -157,6 +498,18 @@ func main() {
 		return
 	}
 
+	// Handle list palettes flag
+	if len(os.Args) == 2 && os.Args[1] == "--list-palettes" {
+		listPalettes()
+		return
+	}
+
+	// Handle list formats flag
+	if len(os.Args) == 2 && os.Args[1] == "--list-formats" {
+		listFormats()
+		return
+	}
+
 	// Hack around issue where required flags are still required even for help
 	// https://github.com/urfave/cli/issues/1247
 	if len(os.Args) == 3 {
@@ -169,7 +522,7 @@ func main() {
 				}
 			}
 			fmt.Println("no command with that name")
-			os.Exit(1)
+			os.Exit(exitUsage)
 		} else if os.Args[len(os.Args)-1] == "-h" || os.Args[len(os.Args)-1] == "--help" {
 			// Like: didder bayer --help
 			for _, c := range app.Commands {
@@ -179,17 +532,23 @@ func main() {
 				}
 			}
 			fmt.Println("no command with that name")
-			os.Exit(1)
+			os.Exit(exitUsage)
 		}
 	}
 
-	err := app.Run(os.Args)
+	args, err := expandPreset(os.Args, app)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(exitCode(usageError{err}))
+	}
+
+	err = app.Run(args)
 	if err != nil {
 		if len(os.Args) == 1 {
 			// Just ran the command with no flags
 			return
 		}
 		fmt.Println(err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// manifestEntry is one output file in the manifest.
+type manifestEntry struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+var (
+	// manifestPath is where the manifest is written, or empty if there's no
+	// manifest
+	manifestPath string
+
+	// manifestFiles are the output files written so far, in order
+	manifestFiles []string
+)
+
+// addToManifest records an output file for the manifest. Files in temporary
+// directories aren't final outputs, so they're left out.
+func addToManifest(path string) {
+	if manifestPath == "" {
+		return
+	}
+	for _, dir := range tempDirs {
+		if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return
+		}
+	}
+	for _, p := range manifestFiles {
+		if p == path {
+			// Written more than once, the hash is of the final file
+			return
+		}
+	}
+	manifestFiles = append(manifestFiles, path)
+}
+
+// hashFile returns the SHA-256 hash of the file as hex.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeManifest writes the path and hash of every output file to
+// manifestPath. If it ends in .json it's a JSON array, otherwise it's the
+// format of sha256sum, so it can be checked with sha256sum -c.
+func writeManifest() error {
+	entries := make([]manifestEntry, len(manifestFiles))
+	for i, path := range manifestFiles {
+		sum, err := hashFile(path)
+		if err != nil {
+			return fmt.Errorf("error hashing '%s' for the manifest: %w", path, err)
+		}
+		entries[i] = manifestEntry{Path: path, SHA256: sum}
+	}
+
+	var b []byte
+	if strings.EqualFold(filepath.Ext(manifestPath), ".json") {
+		var err error
+		b, err = json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+	} else {
+		var sb strings.Builder
+		for _, e := range entries {
+			fmt.Fprintf(&sb, "%s  %s\n", e.SHA256, e.Path)
+		}
+		b = []byte(sb.String())
+	}
+
+	err := os.WriteFile(manifestPath, b, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/makeworld-the-better-one/didder/pkg/didder"
+	"github.com/makeworld-the-better-one/dither/v2"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	montagePadding     = 4
+	montageLabelHeight = 16
+)
+
+// algorithmDitherer returns a Ditherer for one algorithm of the montage and
+// sweep commands. The spec is a command and its argument, like "bayer 4x4" or
+// "edm floydsteinberg", with an optional strength at the end, like
+// "bayer 4x4@64%".
+func algorithmDitherer(spec string, serpentine bool) (*dither.Ditherer, error) {
+	cellStrength := strength
+	if i := strings.LastIndex(spec, "@"); i != -1 {
+		var err error
+		cellStrength, err = parseStrength(spec[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("'%s': strength: %w", spec, err)
+		}
+		spec = spec[:i]
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("'%s' needs a command and an argument. Example: bayer 4x4", spec)
+	}
+
+	d := withPalette(ditherer, palette)
+	switch strings.ToLower(fields[0]) {
+	case "bayer":
+		x, y, err := parseBayerArgs(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", spec, err)
+		}
+		d.Mapper = channelMapper(func(strength float32) dither.PixelMapper {
+			return dither.Bayer(x, y, strength)
+		}, cellStrength)
+	case "odm":
+		matrix, err := parseODMArg(strings.Join(fields[1:], " "))
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", spec, err)
+		}
+		d.Mapper = channelMapper(func(strength float32) dither.PixelMapper {
+			return dither.PixelMapperFromMatrix(matrix, strength)
+		}, cellStrength)
+	case "edm":
+		if channelStrengthSet[0] || channelStrengthSet[1] || channelStrengthSet[2] {
+			return nil, errors.New("edm doesn't support per-channel strength")
+		}
+		matrix, err := parseEDMArg(strings.Join(fields[1:], " "))
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", spec, err)
+		}
+		d.Matrix = dither.ErrorDiffusionStrength(matrix, cellStrength)
+		d.Serpentine = serpentine
+	default:
+		return nil, fmt.Errorf("'%s': only bayer, odm, and edm are supported", spec)
+	}
+	return d, nil
+}
+
+// montage lays out the images in a grid with the given number of columns,
+// with each label written under its image. All the images must be the same
+// size.
+func montage(imgs []image.Image, labels []string, cols int) *image.NRGBA {
+	rows := (len(imgs) + cols - 1) / cols
+	cellW := imgs[0].Bounds().Dx() + montagePadding*2
+	cellH := imgs[0].Bounds().Dy() + montagePadding*2 + montageLabelHeight
+
+	out := imaging.New(cols*cellW, rows*cellH, color.White)
+	face := basicfont.Face7x13
+	for i, img := range imgs {
+		min := image.Pt((i%cols)*cellW+montagePadding, (i/cols)*cellH+montagePadding)
+		b := img.Bounds()
+		draw.Draw(out, b.Sub(b.Min).Add(min), img, b.Min, draw.Src)
+
+		// Cut off labels that are wider than the cell, so they don't overlap
+		label := []rune(labels[i])
+		if max := (cellW - montagePadding) / face.Advance; len(label) > max {
+			label = label[:max]
+		}
+		d := &font.Drawer{
+			Dst:  out,
+			Src:  image.Black,
+			Face: face,
+			Dot:  fixed.P(min.X, min.Y+b.Dy()+montageLabelHeight-face.Descent),
+		}
+		d.DrawString(string(label))
+	}
+	return out
+}
+
+// sweepSpecs returns an algorithm spec for every built-in algorithm, for the
+// sweep command. Bayer matrices are included at a few common sizes.
+func sweepSpecs() []string {
+	specs := []string{"bayer 2x2", "bayer 4x4", "bayer 8x8", "bayer 16x16"}
+
+	for _, name := range didder.OrderedMatrixNames() {
+		specs = append(specs, "odm "+name)
+	}
+	for _, name := range didder.DiffusionMatrixNames() {
+		specs = append(specs, "edm "+name)
+	}
+	return specs
+}
+
+// diffImage compares two images of the same size. Pixels that differ are drawn
+// in the highlight color, and the rest are drawn from the first image but
+// faded towards white, so the differences stand out. The number of differing
+// pixels is returned too.
+func diffImage(a, b image.Image, highlight color.Color) (*image.NRGBA, int) {
+	ab := a.Bounds()
+	bb := b.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, ab.Dx(), ab.Dy()))
+	n := 0
+	for y := 0; y < ab.Dy(); y++ {
+		for x := 0; x < ab.Dx(); x++ {
+			ac := color.NRGBAModel.Convert(a.At(ab.Min.X+x, ab.Min.Y+y)).(color.NRGBA)
+			bc := color.NRGBAModel.Convert(b.At(bb.Min.X+x, bb.Min.Y+y)).(color.NRGBA)
+			if ac != bc {
+				out.Set(x, y, highlight)
+				n++
+				continue
+			}
+			out.SetNRGBA(x, y, color.NRGBA{
+				R: 255 - (255-ac.R)/4,
+				G: 255 - (255-ac.G)/4,
+				B: 255 - (255-ac.B)/4,
+				A: 255,
+			})
+		}
+	}
+	return out, n
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/makeworld-the-better-one/didder/pkg/didder"
+)
+
+// sortPalette reorders the palette colors in place, by order, which is
+// "luminance" or "hue". If recolor isn't empty, its colors are moved along with
+// the palette colors, so the two palettes stay aligned.
+func sortPalette(pal, recolor []color.Color, order string) {
+	// Sort keys: hue (or -1 for grays) then luminance
+	keys := make([][2]float64, len(pal))
+	for i, c := range pal {
+		lum := float64(color.Gray16Model.Convert(c).(color.Gray16).Y)
+		if order == "luminance" {
+			keys[i] = [2]float64{lum, 0}
+		} else {
+			keys[i] = [2]float64{colorHue(c), lum}
+		}
+	}
+
+	indexes := make([]int, len(pal))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		a, b := keys[indexes[i]], keys[indexes[j]]
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		return a[1] < b[1]
+	})
+
+	sorted := make([]color.Color, len(pal))
+	for i, index := range indexes {
+		sorted[i] = pal[index]
+	}
+	copy(pal, sorted)
+	if len(recolor) != 0 {
+		for i, index := range indexes {
+			sorted[i] = recolor[index]
+		}
+		copy(recolor, sorted)
+	}
+}
+
+// colorHue returns the HSL hue of the color in degrees, from 0 up to 360.
+// Grays have no hue, and -1 is returned for them.
+func colorHue(c color.Color) float64 {
+	nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+	r, g, b := float64(nc.R), float64(nc.G), float64(nc.B)
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	if max == min {
+		return -1
+	}
+
+	var h float64
+	switch max {
+	case r:
+		h = (g - b) / (max - min)
+	case g:
+		h = 2 + (b-r)/(max-min)
+	default:
+		h = 4 + (r-g)/(max-min)
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
+// listPalettes prints the names of all built-in palettes, and how many
+// colors they have.
+func listPalettes() {
+	for _, name := range didder.PaletteNames() {
+		pal, _ := didder.NamedPalette(name)
+		fmt.Printf("%s (%d colors)\n", name, len(pal))
+	}
+}
+
+// colorToHex returns the color as a lowercase hex code with a leading '#'.
+// The alpha channel is only included if the color isn't opaque.
+func colorToHex(c color.Color) string {
+	nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+	if nc.A != 255 {
+		return fmt.Sprintf("#%02x%02x%02x%02x", nc.R, nc.G, nc.B, nc.A)
+	}
+	return fmt.Sprintf("#%02x%02x%02x", nc.R, nc.G, nc.B)
+}
+
+// exportPalette writes the palette to the file at path, in the format given
+// by the file extension: CSS custom properties, SCSS variables, or a JSON
+// array of hex codes.
+func exportPalette(pal []color.Color, path string) error {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	if ext != "css" && ext != "scss" && ext != "json" {
+		return fmt.Errorf("can't export palette to '%s', the extension must be .css, .scss, or .json", path)
+	}
+
+	file, err := os.OpenFile(path, outFileFlags, 0644)
+	if err != nil {
+		return fmt.Errorf("error exporting palette: %w", err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	switch ext {
+	case "css":
+		fmt.Fprintln(w, ":root {")
+		for i, c := range pal {
+			fmt.Fprintf(w, "  --color-%d: %s;\n", i, colorToHex(c))
+		}
+		fmt.Fprintln(w, "}")
+	case "scss":
+		for i, c := range pal {
+			fmt.Fprintf(w, "$color-%d: %s;\n", i, colorToHex(c))
+		}
+	case "json":
+		hexes := make([]string, len(pal))
+		for i, c := range pal {
+			hexes[i] = colorToHex(c)
+		}
+		b, _ := json.MarshalIndent(hexes, "", "  ")
+		w.Write(b)
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if err != nil {
+		return fmt.Errorf("error exporting palette: %w", err)
+	}
+	return nil
+}
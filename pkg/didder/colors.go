@@ -0,0 +1,564 @@
+package didder
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/colornames"
+)
+
+// ParseColors parses a space-separated list of colors, in any of the formats
+// of the --palette flag, and returns them in order. Named palettes, gray:N,
+// plte:PATH, and ramps expand to multiple colors. Ramps are interpolated in
+// space, one of RampSpaces. RGBA tuples are only accepted if alpha is true.
+// All returned colors are guaranteed to only be color.NRGBA.
+func ParseColors(arg, space string, alpha bool) ([]color.Color, error) {
+	args := strings.FieldsFunc(joinParens(arg), func(r rune) bool { return r == ' ' })
+	colors := make([]color.Color, 0, len(args))
+
+	for _, arg := range args {
+		// Built-in and generated palettes like gray:4 expand to multiple colors
+
+		if named, ok := namedPalettes[strings.ToLower(arg)]; ok {
+			colors = append(colors, named...)
+			continue
+		}
+
+		if strings.HasPrefix(strings.ToLower(arg), "gray:") || strings.HasPrefix(strings.ToLower(arg), "grey:") {
+			n, err := strconv.Atoi(arg[5:])
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid grayscale ramp. Example: gray:4", arg)
+			}
+			if n < 2 {
+				return nil, errors.New("grayscale ramps must have at least 2 colors")
+			}
+			if n > 256 {
+				return nil, errors.New("grayscale ramps can't have more than 256 colors")
+			}
+			colors = append(colors, GrayRamp(n)...)
+			continue
+		}
+
+		if strings.HasPrefix(strings.ToLower(arg), "plte:") {
+			pal, err := pngPalette(arg[5:])
+			if err != nil {
+				return nil, err
+			}
+			colors = append(colors, pal...)
+			continue
+		}
+
+		if strings.HasPrefix(strings.ToLower(arg), "ramp:") {
+			ramp, err := parseRamp(arg[5:], space, alpha)
+			if err != nil {
+				return nil, err
+			}
+			colors = append(colors, ramp...)
+			continue
+		}
+
+		if strings.HasPrefix(strings.ToLower(arg), "pantone:") && strings.Contains(arg, ",") {
+			// Comma separated list, like pantone:185C,pantone:286C
+			for _, name := range strings.Split(arg, ",") {
+				if !strings.HasPrefix(strings.ToLower(name), "pantone:") {
+					name = "pantone:" + name
+				}
+				pc, err := ParseColor(name, alpha)
+				if err != nil {
+					return nil, err
+				}
+				colors = append(colors, pc)
+			}
+			continue
+		}
+
+		pc, err := ParseColor(arg, alpha)
+		if err != nil {
+			return nil, err
+		}
+		colors = append(colors, pc)
+	}
+
+	return colors, nil
+}
+
+func hexToColor(hex string) (color.NRGBA, error) {
+	// Modified from https://github.com/lucasb-eyer/go-colorful/blob/v1.2.0/colors.go#L333
+
+	hasHash := strings.HasPrefix(hex, "#")
+	hex = strings.TrimPrefix(hex, "#")
+
+	switch len(hex) {
+	case 3, 4:
+		// Shorthand like #f0c, where each digit is doubled
+		// The '#' is required, because without it a number like 123 is a
+		// grayscale value, and a typo in a color name like "fab" would be
+		// read as a color
+		if !hasHash {
+			return color.NRGBA{}, fmt.Errorf("%s is not a hex color", hex)
+		}
+		long := make([]byte, 0, 8)
+		for i := range hex {
+			long = append(long, hex[i], hex[i])
+		}
+		hex = string(long)
+	case 6, 8:
+	default:
+		return color.NRGBA{}, fmt.Errorf("%s is not a hex color", hex)
+	}
+	if len(hex) == 6 {
+		// Opaque
+		hex += "ff"
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("%s is not a hex color", hex)
+	}
+	return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
+
+// cssRGBToColor parses the inside of a CSS rgb() or rgba() function. Values
+// can be separated by commas or spaces, and the alpha value can come after a
+// slash, as in CSS. Colors are 0-255 or a percentage, and alpha is 0-1 or a
+// percentage.
+func cssRGBToColor(s string) (color.NRGBA, error) {
+	parts := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '/'
+	})
+	if len(parts) != 3 && len(parts) != 4 {
+		return color.NRGBA{}, fmt.Errorf("%s doesn't have 3 or 4 values", s)
+	}
+
+	vals := [4]uint8{0, 0, 0, 255}
+	for i, part := range parts {
+		var v float64
+		var err error
+		if strings.HasSuffix(part, "%") {
+			v, err = strconv.ParseFloat(strings.TrimSuffix(part, "%"), 64)
+			v = v / 100 * 255
+		} else if i == 3 {
+			v, err = strconv.ParseFloat(part, 64)
+			v *= 255
+		} else {
+			v, err = strconv.ParseFloat(part, 64)
+		}
+		if err != nil {
+			return color.NRGBA{}, err
+		}
+		if v < 0 || v > 255 {
+			return color.NRGBA{}, fmt.Errorf("%s is out of range", part)
+		}
+		vals[i] = uint8(math.Round(v))
+	}
+	return color.NRGBA{vals[0], vals[1], vals[2], vals[3]}, nil
+}
+
+// hslToColor parses the inside of a CSS-like hsl() function, or hsv() if hsv
+// is true. The hue is in degrees, and the other values are percentages or 0-1.
+// Like cssRGBToColor, an alpha value can be added.
+func hslToColor(s string, hsv bool) (color.NRGBA, error) {
+	parts := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '/'
+	})
+	if len(parts) != 3 && len(parts) != 4 {
+		return color.NRGBA{}, fmt.Errorf("%s doesn't have 3 or 4 values", s)
+	}
+
+	h, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(parts[0]), "deg"), 64)
+	if err != nil {
+		return color.NRGBA{}, err
+	}
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+
+	// Saturation, lightness or value, and alpha, all 0-1
+	vals := [3]float64{0, 0, 1}
+	for i, part := range parts[1:] {
+		var v float64
+		if strings.HasSuffix(part, "%") {
+			v, err = strconv.ParseFloat(strings.TrimSuffix(part, "%"), 64)
+			v /= 100
+		} else {
+			v, err = strconv.ParseFloat(part, 64)
+		}
+		if err != nil {
+			return color.NRGBA{}, err
+		}
+		if v < 0 || v > 1 {
+			return color.NRGBA{}, fmt.Errorf("%s is out of range", part)
+		}
+		vals[i] = v
+	}
+	sat, lv, a := vals[0], vals[1], vals[2]
+
+	// https://en.wikipedia.org/wiki/HSL_and_HSV#Color_conversion_formulae
+	// Both use the same formula, with a different chroma and offset
+	var chroma float64
+	if hsv {
+		chroma = lv * sat
+	} else {
+		chroma = (1 - math.Abs(2*lv-1)) * sat
+	}
+	x := chroma * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = chroma, x, 0
+	case h < 120:
+		r, g, b = x, chroma, 0
+	case h < 180:
+		r, g, b = 0, chroma, x
+	case h < 240:
+		r, g, b = 0, x, chroma
+	case h < 300:
+		r, g, b = x, 0, chroma
+	default:
+		r, g, b = chroma, 0, x
+	}
+	m := lv - chroma
+	if !hsv {
+		m = lv - chroma/2
+	}
+
+	to8 := func(v float64) uint8 {
+		return uint8(math.Round(v * 255))
+	}
+	return color.NRGBA{to8(r + m), to8(g + m), to8(b + m), to8(a)}, nil
+}
+
+// joinParens removes whitespace inside parentheses, so that colors like
+// rgb(37, 150, 190) stay together when color arguments are split by spaces.
+// Whitespace that separates values is replaced with a comma.
+func joinParens(s string) string {
+	var b strings.Builder
+	depth := 0
+	lastComma := false
+	for _, r := range s {
+		switch {
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case depth > 0 && r == ' ':
+			// Values like "rgb(1 2 3)" need a separator, but "rgb(1, 2, 3)"
+			// already has one
+			if !lastComma {
+				b.WriteRune(',')
+				lastComma = true
+			}
+			continue
+		}
+		lastComma = r == ',' || r == '/'
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func rgbToColor(s string) (color.NRGBA, error) {
+	format := "%d,%d,%d"
+	var r, g, b uint8
+	n, err := fmt.Sscanf(s, format, &r, &g, &b)
+	if err != nil {
+		return color.NRGBA{}, err
+	}
+	if n != 3 {
+		return color.NRGBA{}, fmt.Errorf("%s is not an RGB tuple", s)
+	}
+	return color.NRGBA{r, g, b, 255}, nil
+}
+
+func rgbaToColor(s string) (color.NRGBA, error) {
+	format := "%d,%d,%d,%d"
+	var r, g, b, a uint8
+	n, err := fmt.Sscanf(s, format, &r, &g, &b, &a)
+	if err != nil {
+		return color.NRGBA{}, err
+	}
+	if n != 4 {
+		return color.NRGBA{}, fmt.Errorf("%s is not an RGBA tuple", s)
+	}
+	// Parse as non-premult, as that's more user-friendly
+	return color.NRGBA{r, g, b, a}, nil
+}
+
+// GrayRamp returns n evenly spaced grays from black to white, as color.NRGBA.
+// n must be at least 2.
+func GrayRamp(n int) []color.Color {
+	colors := make([]color.Color, n)
+	for i := range colors {
+		v := uint8(math.Round(255 * float64(i) / float64(n-1)))
+		colors[i] = color.NRGBA{v, v, v, 255}
+	}
+	return colors
+}
+
+// ParseColor parses a single color, in any of the formats of the --palette
+// flag. RGBA tuples are only accepted if alpha is true.
+func ParseColor(arg string, alpha bool) (color.NRGBA, error) {
+	// Try to parse as RGB numbers, then hex, then grayscale, then SVG colors, then fail
+	// Optionally try for RGBA, see #1
+
+	if lower := strings.ToLower(arg); strings.Contains(lower, "(") && strings.HasSuffix(lower, ")") {
+		// CSS-like function syntax, like rgb(37, 150, 190)
+		name := lower[:strings.Index(lower, "(")]
+		inner := arg[strings.Index(arg, "(")+1 : len(arg)-1]
+		switch name {
+		case "rgb", "rgba":
+			cssColor, err := cssRGBToColor(inner)
+			if err != nil {
+				return color.NRGBA{}, fmt.Errorf("%s is not a valid CSS color. Example: rgb(25, 200, 150)", arg)
+			}
+			return cssColor, nil
+		case "hsl", "hsla", "hsv", "hsva":
+			hsColor, err := hslToColor(inner, strings.HasPrefix(name, "hsv"))
+			if err != nil {
+				return color.NRGBA{}, fmt.Errorf("%s is not a valid %s color. Example: %s(200, 50%%, 40%%)", arg, name[:3], name[:3])
+			}
+			return hsColor, nil
+		}
+	}
+
+	if strings.HasPrefix(strings.ToLower(arg), "pantone:") {
+		pantoneColor, err := pantoneToColor(arg[len("pantone:"):])
+		if err != nil {
+			return color.NRGBA{}, err
+		}
+		return pantoneColor, nil
+	}
+
+	if strings.Count(arg, ",") == 2 {
+		rgbColor, err := rgbToColor(arg)
+		if err != nil {
+			return color.NRGBA{}, fmt.Errorf("%s is not a valid RGB tuple. Example: 25,200,150", arg)
+		}
+		return rgbColor, nil
+	}
+
+	if alpha && strings.Count(arg, ",") == 3 {
+		rgbaColor, err := rgbaToColor(arg)
+		if err != nil {
+			return color.NRGBA{}, fmt.Errorf("%s is not a valid RGBA tuple. Example: 25,200,150,100", arg)
+		}
+		return rgbaColor, nil
+	}
+
+	hexColor, err := hexToColor(arg)
+	if err == nil {
+		return hexColor, nil
+	}
+
+	n, err := strconv.Atoi(arg)
+	if err == nil {
+		if n > 255 || n < 0 {
+			return color.NRGBA{}, fmt.Errorf("single numbers like %d must be in the range 0-255", n)
+		}
+		return color.NRGBA{uint8(n), uint8(n), uint8(n), 255}, nil
+	}
+
+	htmlColor, ok := colornames.Map[strings.ToLower(arg)]
+	if ok {
+		return color.NRGBAModel.Convert(htmlColor).(color.NRGBA), nil
+	}
+	cssColor, ok := extraColorNames[strings.ToLower(arg)]
+	if ok {
+		return cssColor, nil
+	}
+
+	return color.NRGBA{}, fmt.Errorf("%s not recognized as an RGB tuple, hex code, number 0-255, or CSS color name", arg)
+}
+
+// parseRamp parses a ramp argument like "ramp:black,red,white:8", without the
+// "ramp:" prefix. The anchor colors are parsed with ParseColor, but can't be
+// RGB tuples because of the commas.
+func parseRamp(arg, space string, alpha bool) ([]color.Color, error) {
+	sep := strings.LastIndex(arg, ":")
+	if sep == -1 {
+		return nil, fmt.Errorf("ramp:%s is not a valid ramp. Example: ramp:black,red:8", arg)
+	}
+	n, err := strconv.Atoi(arg[sep+1:])
+	if err != nil {
+		return nil, fmt.Errorf("ramp:%s is not a valid ramp. Example: ramp:black,red:8", arg)
+	}
+
+	anchorArgs := strings.Split(arg[:sep], ",")
+	if len(anchorArgs) < 2 {
+		return nil, errors.New("ramps need at least two colors to interpolate between")
+	}
+	if n < len(anchorArgs) {
+		return nil, errors.New("ramps must have at least as many steps as colors")
+	}
+
+	anchors := make([]color.NRGBA, len(anchorArgs))
+	for i, anchorArg := range anchorArgs {
+		anchors[i], err = ParseColor(anchorArg, alpha)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return interpolateColors(anchors, n, space), nil
+}
+
+// RampSpaces lists the color spaces ramps can be interpolated in.
+var RampSpaces = []string{"srgb", "linear", "oklab", "lab"}
+
+// interpolateColors returns n colors evenly interpolated between the anchor
+// colors, which are included. Interpolation happens in the provided color
+// space, one of RampSpaces.
+func interpolateColors(anchors []color.NRGBA, n int, space string) []color.Color {
+	var toSpace func(color.NRGBA) [3]float64
+	var fromSpace func([3]float64) (uint8, uint8, uint8)
+	switch space {
+	case "linear":
+		toSpace = func(c color.NRGBA) [3]float64 {
+			return [3]float64{
+				linearize(float64(c.R) / 255),
+				linearize(float64(c.G) / 255),
+				linearize(float64(c.B) / 255),
+			}
+		}
+		fromSpace = func(v [3]float64) (uint8, uint8, uint8) {
+			return toUint8(delinearize(v[0])), toUint8(delinearize(v[1])), toUint8(delinearize(v[2]))
+		}
+	case "oklab":
+		toSpace, fromSpace = toOklab, fromOklab
+	case "lab":
+		toSpace, fromSpace = toLab, fromLab
+	default:
+		toSpace = func(c color.NRGBA) [3]float64 {
+			return [3]float64{float64(c.R) / 255, float64(c.G) / 255, float64(c.B) / 255}
+		}
+		fromSpace = func(v [3]float64) (uint8, uint8, uint8) {
+			return toUint8(v[0]), toUint8(v[1]), toUint8(v[2])
+		}
+	}
+
+	colors := make([]color.Color, n)
+	for i := range colors {
+		// Position along all the anchors
+		pos := float64(i) / float64(n-1) * float64(len(anchors)-1)
+		seg := int(pos)
+		if seg >= len(anchors)-1 {
+			seg = len(anchors) - 2
+		}
+		t := pos - float64(seg)
+
+		a, b := anchors[seg], anchors[seg+1]
+		va, vb := toSpace(a), toSpace(b)
+		var v [3]float64
+		for j := range v {
+			v[j] = va[j] + (vb[j]-va[j])*t
+		}
+		nc := color.NRGBA{A: uint8(math.Round(float64(a.A) + (float64(b.A)-float64(a.A))*t))}
+		nc.R, nc.G, nc.B = fromSpace(v)
+		colors[i] = nc
+	}
+	return colors
+}
+
+// toUint8 converts a value in the range [0, 1] to a color channel, clamping
+// values that are out of range.
+func toUint8(v float64) uint8 {
+	return uint8(math.Round(math.Max(0, math.Min(v, 1)) * 255))
+}
+
+// toOklab converts the color to Oklab, ignoring alpha.
+// See https://bottosson.github.io/posts/oklab/
+func toOklab(c color.NRGBA) [3]float64 {
+	r := linearize(float64(c.R) / 255)
+	g := linearize(float64(c.G) / 255)
+	b := linearize(float64(c.B) / 255)
+
+	l := math.Cbrt(0.4122214708*r + 0.5363325363*g + 0.0514459929*b)
+	m := math.Cbrt(0.2119034982*r + 0.6806995451*g + 0.1073969566*b)
+	s := math.Cbrt(0.0883024619*r + 0.2817188376*g + 0.6299787005*b)
+
+	return [3]float64{
+		0.2104542553*l + 0.7936177850*m - 0.0040720468*s,
+		1.9779984951*l - 2.4285922050*m + 0.4505937099*s,
+		0.0259040371*l + 0.7827717662*m - 0.8086757660*s,
+	}
+}
+
+// fromOklab converts an Oklab color to sRGB channels.
+func fromOklab(v [3]float64) (uint8, uint8, uint8) {
+	l := v[0] + 0.3963377774*v[1] + 0.2158037573*v[2]
+	m := v[0] - 0.1055613458*v[1] - 0.0638541728*v[2]
+	s := v[0] - 0.0894841775*v[1] - 1.2914855480*v[2]
+	l, m, s = l*l*l, m*m*m, s*s*s
+
+	r := 4.0767416621*l - 3.3077115913*m + 0.2309699292*s
+	g := -1.2684380046*l + 2.6097574011*m - 0.3413193965*s
+	b := -0.0041960863*l - 0.7034186147*m + 1.7076147010*s
+	return toUint8(delinearize(r)), toUint8(delinearize(g)), toUint8(delinearize(b))
+}
+
+// D65 white point, for CIELAB
+const (
+	whiteX = 0.95047
+	whiteY = 1.0
+	whiteZ = 1.08883
+)
+
+// toLab converts the color to CIELAB with a D65 white point, ignoring alpha.
+func toLab(c color.NRGBA) [3]float64 {
+	r := linearize(float64(c.R) / 255)
+	g := linearize(float64(c.G) / 255)
+	b := linearize(float64(c.B) / 255)
+
+	x := (0.4124564*r + 0.3575761*g + 0.1804375*b) / whiteX
+	y := (0.2126729*r + 0.7151522*g + 0.0721750*b) / whiteY
+	z := (0.0193339*r + 0.1191920*g + 0.9503041*b) / whiteZ
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+// fromLab converts a CIELAB color with a D65 white point to sRGB channels.
+func fromLab(v [3]float64) (uint8, uint8, uint8) {
+	fy := (v[0] + 16) / 116
+	fx := fy + v[1]/500
+	fz := fy - v[2]/200
+
+	finv := func(t float64) float64 {
+		if t*t*t > 216.0/24389 {
+			return t * t * t
+		}
+		return (116*t - 16) * 27 / 24389
+	}
+	x, y, z := finv(fx)*whiteX, finv(fy)*whiteY, finv(fz)*whiteZ
+
+	r := 3.2404542*x - 1.5371385*y - 0.4985314*z
+	g := -0.9692660*x + 1.8760108*y + 0.0415560*z
+	b := 0.0556434*x - 0.2040259*y + 1.0572252*z
+	return toUint8(delinearize(r)), toUint8(delinearize(g)), toUint8(delinearize(b))
+}
+
+// linearize converts an sRGB value in the range [0, 1] to linear RGB.
+func linearize(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// delinearize converts a linear RGB value in the range [0, 1] to sRGB.
+func delinearize(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
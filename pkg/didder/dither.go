@@ -0,0 +1,156 @@
+// Package didder has the palette parsing and dithering of the didder command,
+// so they can be used from other Go programs. Colors and algorithms are
+// written the same way as on the command line.
+//
+// Loading, adjusting, and writing images is left to the caller. For anything
+// not covered here, use the dither library directly:
+// https://github.com/makeworld-the-better-one/dither
+package didder
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/makeworld-the-better-one/dither/v2"
+)
+
+// Config holds the settings for Dither.
+type Config struct {
+	// Palette holds the colors the image is dithered to. ParseColors can be
+	// used to write them like the --palette flag. Colors with alpha are
+	// dithered as if they were opaque, and get their alpha back afterward.
+	Palette []color.Color
+
+	// Recolor holds colors that replace the palette colors after dithering,
+	// like the --recolor flag. It's optional, but if it's set it must have a
+	// color for each palette color, in the same order.
+	Recolor []color.Color
+
+	// Algorithm is the dithering command and its argument, like on the
+	// command line. For example "bayer 4x4", "odm ClusteredDot4x4", or
+	// "edm FloydSteinberg". Only built-in matrices can be used.
+	Algorithm string
+
+	// Strength is the strength of dithering, where 1 is full strength. Zero
+	// means no dithering, so each pixel just becomes the closest color.
+	Strength float32
+
+	// Serpentine makes error diffusion go right-to-left every other line,
+	// which reduces line artifacts. It's only used with "edm".
+	Serpentine bool
+
+	// Grayscale converts the image to grayscale before dithering. It's done
+	// automatically if every palette color is a shade of gray.
+	Grayscale bool
+}
+
+// NewConfig returns a Config for the palette and algorithm, with the same
+// defaults as the didder command, so dithering is at full strength.
+func NewConfig(palette []color.Color, algorithm string) Config {
+	return Config{Palette: palette, Algorithm: algorithm, Strength: 1}
+}
+
+// Dither dithers the image with the settings in the Config. The returned
+// image uses the palette in the same order, or Recolor if it's set. The
+// provided image isn't changed.
+func Dither(img image.Image, cfg Config) (*image.Paletted, error) {
+	if len(cfg.Palette) == 0 {
+		return nil, errors.New("the palette is empty")
+	}
+	if len(cfg.Recolor) != 0 && len(cfg.Recolor) != len(cfg.Palette) {
+		return nil, errors.New("the recolor palette must have the same number of colors as the palette")
+	}
+
+	// Dithering ignores alpha, so it's dithered with opaque colors, and the
+	// original ones are used for the output
+	opaque := make([]color.Color, len(cfg.Palette))
+	gray := true
+	for i, c := range cfg.Palette {
+		nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+		nc.A = 255
+		opaque[i] = nc
+		if nc.R != nc.G || nc.G != nc.B {
+			gray = false
+		}
+	}
+
+	d := dither.NewDitherer(opaque)
+	err := setAlgorithm(d, cfg.Algorithm, cfg.Strength, cfg.Serpentine)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Grayscale || gray {
+		img = imaging.Grayscale(img)
+	}
+
+	// Dithered in 16-bit, so no precision is lost before dithering, and so
+	// the provided image is never changed
+	src := image.NewRGBA64(img.Bounds())
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	p := image.NewPaletted(src.Bounds(), d.GetPalette())
+	dithered := DitherWith(d, src)
+	draw.Draw(p, p.Bounds(), dithered, dithered.Bounds().Min, draw.Src)
+
+	if len(cfg.Recolor) != 0 {
+		copy(p.Palette, cfg.Recolor)
+	} else {
+		copy(p.Palette, cfg.Palette)
+	}
+	return p, nil
+}
+
+// setAlgorithm sets up the Ditherer for an algorithm like "bayer 4x4", at
+// the strength.
+func setAlgorithm(d *dither.Ditherer, algorithm string, strength float32, serpentine bool) error {
+	fields := strings.Fields(algorithm)
+	if len(fields) < 2 {
+		return fmt.Errorf("'%s' needs a command and an argument. Example: bayer 4x4", algorithm)
+	}
+	arg := strings.Join(fields[1:], " ")
+
+	switch strings.ToLower(fields[0]) {
+	case "bayer":
+		size := strings.FieldsFunc(arg, func(r rune) bool {
+			return r == ' ' || r == ',' || r == 'x'
+		})
+		if len(size) != 2 {
+			return errors.New("bayer needs 2 arguments exactly. Example: 4x4")
+		}
+		x, err := strconv.ParseUint(size[0], 10, 0)
+		if err != nil {
+			return err
+		}
+		y, err := strconv.ParseUint(size[1], 10, 0)
+		if err != nil {
+			return err
+		}
+		err = CheckBayerSize(uint(x), uint(y))
+		if err != nil {
+			return err
+		}
+		d.Mapper = dither.Bayer(uint(x), uint(y), strength)
+	case "odm":
+		matrix, ok := OrderedMatrix(arg)
+		if !ok {
+			return fmt.Errorf("'%s' is not a built-in ordered dither matrix", arg)
+		}
+		d.Mapper = dither.PixelMapperFromMatrix(matrix, strength)
+	case "edm":
+		matrix, ok := DiffusionMatrix(arg)
+		if !ok {
+			return fmt.Errorf("'%s' is not a built-in error diffusion matrix", arg)
+		}
+		d.Matrix = dither.ErrorDiffusionStrength(matrix, strength)
+		d.Serpentine = serpentine
+	default:
+		return fmt.Errorf("'%s': only bayer, odm, and edm are supported", algorithm)
+	}
+	return nil
+}
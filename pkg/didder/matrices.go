@@ -0,0 +1,106 @@
+package didder
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/makeworld-the-better-one/dither/v2"
+)
+
+// orderedMatrices holds the ordered dither matrices of the dither library, by
+// lower case name.
+var orderedMatrices = map[string]dither.OrderedDitherMatrix{
+	"clustereddot4x4":            dither.ClusteredDot4x4,
+	"clustereddotdiagonal8x8":    dither.ClusteredDotDiagonal8x8,
+	"vertical5x3":                dither.Vertical5x3,
+	"horizontal3x5":              dither.Horizontal3x5,
+	"clustereddotdiagonal6x6":    dither.ClusteredDotDiagonal6x6,
+	"clustereddotdiagonal8x8_2":  dither.ClusteredDotDiagonal8x8_2,
+	"clustereddotdiagonal16x16":  dither.ClusteredDotDiagonal16x16,
+	"clustereddot6x6":            dither.ClusteredDot6x6,
+	"clustereddotspiral5x5":      dither.ClusteredDotSpiral5x5,
+	"clustereddothorizontalline": dither.ClusteredDotHorizontalLine,
+	"clustereddotverticalline":   dither.ClusteredDotVerticalLine,
+	"clustereddot8x8":            dither.ClusteredDot8x8,
+	"clustereddot6x6_2":          dither.ClusteredDot6x6_2,
+	"clustereddot6x6_3":          dither.ClusteredDot6x6_3,
+	"clustereddotdiagonal8x8_3":  dither.ClusteredDotDiagonal8x8_3,
+}
+
+// diffusionMatrices holds the error diffusion matrices of the dither library,
+// by lower case name.
+var diffusionMatrices = map[string]dither.ErrorDiffusionMatrix{
+	"simple2d":            dither.Simple2D,
+	"floydsteinberg":      dither.FloydSteinberg,
+	"falsefloydsteinberg": dither.FalseFloydSteinberg,
+	"jarvisjudiceninke":   dither.JarvisJudiceNinke,
+	"atkinson":            dither.Atkinson,
+	"stucki":              dither.Stucki,
+	"burkes":              dither.Burkes,
+	"sierra":              dither.Sierra,
+	"sierra3":             dither.Sierra3,
+	"tworowsierra":        dither.TwoRowSierra,
+	"sierralite":          dither.SierraLite,
+	"sierra2_4a":          dither.Sierra2_4A,
+	"stevenpigeon":        dither.StevenPigeon,
+}
+
+// matrixKey returns the map key for a matrix name. Names are case
+// insensitive, and dashes can be used instead of underscores.
+func matrixKey(name string) string {
+	return strings.ReplaceAll(strings.ToLower(name), "-", "_")
+}
+
+// OrderedMatrix returns the ordered dither matrix with that name, like
+// "ClusteredDot4x4", and false if there's no such matrix.
+func OrderedMatrix(name string) (dither.OrderedDitherMatrix, bool) {
+	m, ok := orderedMatrices[matrixKey(name)]
+	return m, ok
+}
+
+// DiffusionMatrix returns the error diffusion matrix with that name, like
+// "FloydSteinberg", and false if there's no such matrix.
+func DiffusionMatrix(name string) (dither.ErrorDiffusionMatrix, bool) {
+	m, ok := diffusionMatrices[matrixKey(name)]
+	return m, ok
+}
+
+// OrderedMatrixNames returns the lower case names of all the ordered dither
+// matrices, sorted.
+func OrderedMatrixNames() []string {
+	names := make([]string, 0, len(orderedMatrices))
+	for name := range orderedMatrices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DiffusionMatrixNames returns the lower case names of all the error
+// diffusion matrices, sorted.
+func DiffusionMatrixNames() []string {
+	names := make([]string, 0, len(diffusionMatrices))
+	for name := range diffusionMatrices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckBayerSize returns an error if a Bayer matrix can't be made with those
+// dimensions, which would make dither.Bayer panic.
+func CheckBayerSize(x, y uint) error {
+	if x == 0 || y == 0 {
+		return errors.New("neither dimension can be 0")
+	}
+	if x == 1 && y == 1 {
+		return errors.New("a 1x1 matrix will not dither the image")
+	}
+	if ((x&(x-1)) != 0 || (y&(y-1)) != 0) && // Power of two?
+		!((x == 3 && y == 3) || (x == 5 && y == 3) || (x == 3 && y == 5)) { // Exceptions
+		// Not a power of two, and not an exception
+		return errors.New("both dimensions must be powers of two")
+	}
+	return nil
+}
@@ -0,0 +1,375 @@
+package didder
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/makeworld-the-better-one/dither/v2"
+)
+
+// treeMinColors is the smallest palette that's dithered using a colorTree.
+// For smaller palettes, checking every color is just as fast.
+const treeMinColors = 64
+
+// lastTree is the colorTree that was used last. It's reused as long as the
+// same Ditherer is used, so the tree is only built once for it.
+var lastTree struct {
+	sync.Mutex
+	t *colorTree
+}
+
+// colorTree is a k-d tree of the palette colors of a Ditherer, in linear RGB.
+// It finds the closest palette color without checking every color, and gives
+// exactly the same results as the dither library.
+type colorTree struct {
+	d       *dither.Ditherer
+	palette []color.Color
+	linear  [][3]uint16
+	nodes   []colorNode
+	root    int
+}
+
+// colorNode is a single palette color in a colorTree. Colors in the left
+// subtree are at or below it on the axis, and colors in the right subtree
+// are at or above it. -1 means there's no subtree.
+type colorNode struct {
+	index       int
+	axis        int
+	left, right int
+}
+
+// newColorTree returns a colorTree for the palette of the Ditherer.
+func newColorTree(d *dither.Ditherer) *colorTree {
+	t := &colorTree{d: d, palette: d.GetPalette()}
+	t.linear = make([][3]uint16, len(t.palette))
+	indexes := make([]int, len(t.palette))
+	for i := range t.palette {
+		// GetPalette always returns color.RGBA64
+		c := t.palette[i].(color.RGBA64)
+		t.linear[i] = [3]uint16{linearize65535(c.R), linearize65535(c.G), linearize65535(c.B)}
+		indexes[i] = i
+	}
+	t.nodes = make([]colorNode, 0, len(t.palette))
+	t.root = t.build(indexes)
+	return t
+}
+
+// build adds the colors at the indexes to the tree, and returns the node at
+// the top of them.
+func (t *colorTree) build(indexes []int) int {
+	if len(indexes) == 0 {
+		return -1
+	}
+
+	// Split along the axis where the colors are furthest apart
+	axis, widest := 0, uint32(0)
+	for a := 0; a < 3; a++ {
+		lo, hi := uint16(math.MaxUint16), uint16(0)
+		for _, i := range indexes {
+			v := t.linear[i][a]
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if w := axisDist(a, int32(hi)-int32(lo)); w >= widest {
+			axis, widest = a, w
+		}
+	}
+
+	sort.Slice(indexes, func(i, j int) bool {
+		return t.linear[indexes[i]][axis] < t.linear[indexes[j]][axis]
+	})
+	mid := len(indexes) / 2
+
+	n := len(t.nodes)
+	t.nodes = append(t.nodes, colorNode{index: indexes[mid], axis: axis})
+	left := t.build(indexes[:mid])
+	right := t.build(indexes[mid+1:])
+	t.nodes[n].left, t.nodes[n].right = left, right
+	return n
+}
+
+// closest returns the index of the palette color closest to the linear RGB
+// color. Like the dither library, the first color in the palette wins ties.
+func (t *colorTree) closest(r, g, b uint16) int {
+	best, bestDist := -1, uint32(math.MaxUint32)
+	t.search(t.root, [3]uint16{r, g, b}, &best, &bestDist)
+	return best
+}
+
+func (t *colorTree) search(n int, c [3]uint16, best *int, bestDist *uint32) {
+	node := t.nodes[n]
+	p := t.linear[node.index]
+	dist := colorDist(c, p)
+	if dist < *bestDist || (dist == *bestDist && node.index < *best) {
+		*best, *bestDist = node.index, dist
+	}
+
+	diff := int32(c[node.axis]) - int32(p[node.axis])
+	near, far := node.left, node.right
+	if diff > 0 {
+		near, far = far, near
+	}
+	if near != -1 {
+		t.search(near, c, best, bestDist)
+	}
+	// Colors on the far side are at least as far away as the split on this
+	// axis. Equal distances are still checked, because an earlier palette
+	// color might be there.
+	if far != -1 && axisDist(node.axis, diff) <= *bestDist {
+		t.search(far, c, best, bestDist)
+	}
+}
+
+// colorWeights are the luminance weights the dither library uses for the
+// distance between colors, as fractions to keep it in integer math.
+var colorWeights = [3][2]uint64{{1063, 5000}, {447, 625}, {361, 5000}}
+
+// axisDist returns the weighted squared distance for a difference on a
+// single axis. It's rounded down the same way the dither library does it.
+func axisDist(axis int, diff int32) uint32 {
+	d := uint32(diff)
+	sq := uint64((d * d) >> 2)
+	return uint32(colorWeights[axis][0] * sq / colorWeights[axis][1])
+}
+
+// colorDist returns the distance between two linear RGB colors, exactly as
+// the dither library calculates it.
+func colorDist(c1, c2 [3]uint16) uint32 {
+	var sum uint64
+	for a := 0; a < 3; a++ {
+		d := uint32(c1[a]) - uint32(c2[a])
+		sum += colorWeights[a][0] * uint64((d*d)>>2) / colorWeights[a][1]
+	}
+	return uint32(sum)
+}
+
+// DitherWith dithers the image with the Ditherer, like (*dither.Ditherer).Dither.
+// For large palettes it's done here instead, so that a k-d tree can be used
+// to find the closest colors, which is much faster. The output is the same.
+func DitherWith(d *dither.Ditherer, img image.Image) image.Image {
+	if (d.Mapper == nil) == (d.Matrix == nil) || d.Special != 0 {
+		// Invalid, let the library handle it
+		return d.Dither(img)
+	}
+
+	lastTree.Lock()
+	t := lastTree.t
+	if t == nil || t.d != d {
+		if len(d.GetPalette()) < treeMinColors {
+			lastTree.Unlock()
+			return d.Dither(img)
+		}
+		t = newColorTree(d)
+		lastTree.t = t
+	}
+	lastTree.Unlock()
+	return t.dither(img)
+}
+
+// dither is the same as (*dither.Ditherer).Dither, but with the colorTree.
+// Adapted from:
+// https://github.com/makeworld-the-better-one/dither/blob/v2.4.0/dither.go
+func (t *colorTree) dither(src image.Image) image.Image {
+	d := t.d
+
+	var img draw.Image
+	if pi, ok := src.(*image.Paletted); ok {
+		if !samePalette(t.palette, pi.Palette) {
+			// Can't use this because it will change image colors
+			img = copyOfImage(src)
+		} else {
+			img = pi
+		}
+	} else if img, ok = src.(draw.Image); !ok {
+		img = copyOfImage(src)
+	}
+
+	if d.Mapper != nil {
+		workers := 1
+		if !d.SingleThreaded {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		parallelPixels(workers, img, func(x, y int, c color.Color) color.Color {
+			r, g, b, a := unpremultAndLinearize(c)
+			if a == 0 {
+				// Pixel is transparent, don't dither it
+				return c
+			}
+			return premult(t.palette[t.closest(d.Mapper(x, y, r, g, b))].(color.RGBA64), img.At(x, y))
+		})
+		return img
+	}
+
+	// Error diffusion, with the linear values stored separately
+	b := img.Bounds()
+	curPx := d.Matrix.CurrentPixel()
+	lins := make([][][3]uint16, b.Dy())
+	for y := range lins {
+		lins[y] = make([][3]uint16, b.Dx())
+		for x := range lins[y] {
+			r, g, bl, _ := unpremultAndLinearize(img.At(b.Min.X+x, b.Min.Y+y))
+			lins[y][x] = [3]uint16{r, g, bl}
+		}
+	}
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for i := b.Min.X; i < b.Max.X; i++ {
+			x := i
+			if d.Serpentine && y%2 == 0 {
+				// Reverse direction
+				x = b.Max.X - 1 - (i - b.Min.X)
+			}
+
+			old := lins[y-b.Min.Y][x-b.Min.X]
+			idx := t.closest(old[0], old[1], old[2])
+			img.Set(x, y, premult(t.palette[idx].(color.RGBA64), img.At(x, y)))
+
+			// Quant errors in each channel
+			q := t.linear[idx]
+			er := float32(int32(old[0]) - int32(q[0]))
+			eg := float32(int32(old[1]) - int32(q[1]))
+			eb := float32(int32(old[2]) - int32(q[2]))
+
+			for yy := range d.Matrix {
+				for xx := range d.Matrix[yy] {
+					if d.Matrix[yy][xx] == 0 {
+						continue
+					}
+					deltaX, deltaY := d.Matrix.Offset(xx, yy, curPx)
+					if d.Serpentine && y%2 == 0 {
+						// Reflect the matrix horizontally because we're going right-to-left
+						deltaX *= -1
+					}
+					pt := image.Pt(x+deltaX, y+deltaY)
+					if !pt.In(b) {
+						continue
+					}
+					v := &lins[pt.Y-b.Min.Y][pt.X-b.Min.X]
+					v[0] = dither.RoundClamp(float32(v[0]) + er*d.Matrix[yy][xx])
+					v[1] = dither.RoundClamp(float32(v[1]) + eg*d.Matrix[yy][xx])
+					v[2] = dither.RoundClamp(float32(v[2]) + eb*d.Matrix[yy][xx])
+				}
+			}
+		}
+	}
+	return img
+}
+
+// parallelPixels changes every pixel of the image with f, split into rows
+// between the workers. Adapted from the dither library.
+func parallelPixels(workers int, img draw.Image, f func(x, y int, c color.Color) color.Color) {
+	b := img.Bounds()
+	rows := func(minY, maxY int) {
+		for y := minY; y < maxY; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				img.Set(x, y, f(x, y, img.At(x, y)))
+			}
+		}
+	}
+
+	height := b.Dy()
+	if workers > height {
+		workers = height
+	}
+	if workers <= 1 {
+		rows(b.Min.Y, b.Max.Y)
+		return
+	}
+
+	part := height / workers
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		minY := b.Min.Y + part*i
+		maxY := minY + part
+		if i == workers-1 {
+			// Last part gets the leftover rows
+			maxY = b.Max.Y
+		}
+		wg.Add(1)
+		go func() {
+			rows(minY, maxY)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+// premult returns the palette color with the alpha of the original pixel,
+// premultiplied. Adapted from the dither library.
+func premult(c color.RGBA64, orig color.Color) color.RGBA64 {
+	_, _, _, a := orig.RGBA()
+	if a == 0 {
+		// Transparent, no color values are held
+		return color.RGBA64{}
+	}
+	if a == 0xffff {
+		return c
+	}
+	return color.RGBA64{
+		R: uint16(uint32(c.R) * a / 0xffff),
+		G: uint16(uint32(c.G) * a / 0xffff),
+		B: uint16(uint32(c.B) * a / 0xffff),
+		A: uint16(a),
+	}
+}
+
+// unpremultAndLinearize returns the linear RGB values of the color, and its
+// alpha. Adapted from the dither library.
+func unpremultAndLinearize(c color.Color) (uint16, uint16, uint16, uint16) {
+	switch v := c.(type) {
+	case color.Gray:
+		g := linearize255to65535(v.Y)
+		return g, g, g, 0xffff
+	case color.Gray16:
+		g := linearize65535(v.Y)
+		return g, g, g, 0xffff
+	case color.NRGBA:
+		return linearize255to65535(v.R), linearize255to65535(v.G), linearize255to65535(v.B), uint16(v.A) * 257
+	case color.NRGBA64:
+		return linearize65535(v.R), linearize65535(v.G), linearize65535(v.B), v.A
+	}
+	v := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+	return linearize65535(v.R), linearize65535(v.G), linearize65535(v.B), v.A
+}
+
+func linearize65535(i uint16) uint16 {
+	return uint16(math.RoundToEven(linearize(float64(i)/65535.0) * 65535.0))
+}
+
+func linearize255to65535(i uint8) uint16 {
+	return uint16(math.RoundToEven(linearize(float64(i)/255.0) * 65535.0))
+}
+
+func copyOfImage(img image.Image) *image.RGBA {
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, img.Bounds(), img, img.Bounds().Min, draw.Src)
+	return dst
+}
+
+// samePalette returns true if both palettes contain the same colors,
+// regardless of order.
+func samePalette(p1, p2 []color.Color) bool {
+	if len(p1) != len(p2) {
+		return false
+	}
+	diff := make(map[color.Color]int, len(p1))
+	for _, c := range p1 {
+		diff[c]++
+	}
+	for _, c := range p2 {
+		if diff[c] == 0 {
+			return false
+		}
+		diff[c]--
+	}
+	return true
+}
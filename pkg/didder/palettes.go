@@ -0,0 +1,107 @@
+package didder
+
+import (
+	"fmt"
+	"image/color"
+	"image/png"
+	"os"
+	"sort"
+)
+
+// namedPalettes holds built-in palettes that can be used by name in any
+// list of colors. All colors are color.NRGBA.
+var namedPalettes = map[string][]color.Color{
+	// CGA 4-color mode, palette 1 with high intensity
+	"cga": hexPalette("000000", "55ffff", "ff55ff", "ffffff"),
+	// CGA 4-color mode, palette 0 with high intensity
+	"cga0": hexPalette("000000", "55ff55", "ff5555", "ffff55"),
+	// Default EGA palette, which is also the full CGA 16-color palette
+	"ega": hexPalette(
+		"000000", "0000aa", "00aa00", "00aaaa", "aa0000", "aa00aa", "aa5500", "aaaaaa",
+		"555555", "5555ff", "55ff55", "55ffff", "ff5555", "ff55ff", "ffff55", "ffffff",
+	),
+	// Original Game Boy (DMG) greens, from dark to light
+	"gameboy": hexPalette("0f380f", "306230", "8bac0f", "9bbc0f"),
+	"websafe": websafePalette(),
+}
+
+// hexPalette creates a palette from hex codes. It panics if a code is invalid,
+// so it should only be used for built-in palettes.
+func hexPalette(hexes ...string) []color.Color {
+	colors := make([]color.Color, len(hexes))
+	for i, hex := range hexes {
+		c, err := hexToColor(hex)
+		if err != nil {
+			panic(err)
+		}
+		colors[i] = c
+	}
+	return colors
+}
+
+// extraColorNames holds CSS color names that aren't in the SVG 1.1 spec, and
+// so aren't in the colornames package.
+var extraColorNames = map[string]color.NRGBA{
+	// Added in CSS Color Level 4
+	"rebeccapurple": {0x66, 0x33, 0x99, 255},
+	// Transparent black, like in CSS
+	"transparent": {0, 0, 0, 0},
+}
+
+// websafePalette returns the 216 web-safe colors, where each channel is a
+// multiple of 51.
+func websafePalette() []color.Color {
+	colors := make([]color.Color, 0, 216)
+	for r := 0; r <= 255; r += 51 {
+		for g := 0; g <= 255; g += 51 {
+			for b := 0; b <= 255; b += 51 {
+				colors = append(colors, color.NRGBA{uint8(r), uint8(g), uint8(b), 255})
+			}
+		}
+	}
+	return colors
+}
+
+// pngPalette returns the palette stored in the PLTE chunk of an indexed PNG
+// file, in the same order. Transparency from the tRNS chunk is kept.
+func pngPalette(path string) ([]color.Color, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg, err := png.DecodeConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read '%s' as a PNG: %w", path, err)
+	}
+	pal, ok := cfg.ColorModel.(color.Palette)
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not an indexed PNG, so it has no palette", path)
+	}
+	colors := make([]color.Color, len(pal))
+	for i, c := range pal {
+		colors[i] = color.NRGBAModel.Convert(c)
+	}
+	return colors, nil
+}
+
+// NamedPalette returns a copy of the built-in palette with that name, like
+// "gameboy", and false if there's no such palette.
+func NamedPalette(name string) ([]color.Color, bool) {
+	pal, ok := namedPalettes[name]
+	if !ok {
+		return nil, false
+	}
+	return append([]color.Color(nil), pal...), true
+}
+
+// PaletteNames returns the names of all the built-in palettes, sorted.
+func PaletteNames() []string {
+	names := make([]string, 0, len(namedPalettes))
+	for name := range namedPalettes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
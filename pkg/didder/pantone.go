@@ -0,0 +1,111 @@
+package didder
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+)
+
+// pantoneColors holds sRGB approximations of some common Pantone solid coated
+// spot colors, for palettes like "pantone:185C". Keys are upper case, without
+// spaces. These are only approximations, many spot inks are outside of sRGB.
+var pantoneColors = map[string]string{
+	// Basic and named colors
+	"YELLOWC":       "fedd00",
+	"YELLOW012C":    "ffd700",
+	"ORANGE021C":    "fe5000",
+	"WARMREDC":      "f9423a",
+	"RED032C":       "ef3340",
+	"RUBINEREDC":    "ce0058",
+	"RHODAMINEREDC": "e10098",
+	"PURPLEC":       "bb29bb",
+	"VIOLETC":       "440099",
+	"BLUE072C":      "10069f",
+	"REFLEXBLUEC":   "001489",
+	"PROCESSBLUEC":  "0085ca",
+	"GREENC":        "00ab84",
+	"BLACKC":        "2d2926",
+
+	// Yellows and oranges
+	"109C":  "ffd100",
+	"116C":  "ffcd00",
+	"123C":  "ffc72c",
+	"130C":  "f2a900",
+	"151C":  "ff8200",
+	"165C":  "ff671f",
+	"172C":  "fa4616",
+	"1235C": "ffb81c",
+	"1505C": "ff6900",
+	"7406C": "f1c400",
+
+	// Reds
+	"185C":  "e4002b",
+	"186C":  "c8102e",
+	"199C":  "d50032",
+	"200C":  "ba0c2f",
+	"201C":  "9d2235",
+	"202C":  "862633",
+	"485C":  "da291c",
+	"1795C": "d22630",
+	"1805C": "af272f",
+	"7621C": "ab2328",
+	"7622C": "93272c",
+
+	// Purples
+	"266C":  "753bbd",
+	"268C":  "582c83",
+	"2685C": "330072",
+
+	// Blues
+	"280C":  "012169",
+	"281C":  "00205b",
+	"286C":  "0033a0",
+	"287C":  "003087",
+	"293C":  "003da5",
+	"294C":  "002f6c",
+	"295C":  "002855",
+	"300C":  "005eb8",
+	"306C":  "00b5e2",
+	"2728C": "0047bb",
+	"3005C": "0077c8",
+
+	// Teals and greens
+	"320C": "009ca6",
+	"326C": "00b2a9",
+	"347C": "009a44",
+	"348C": "00843d",
+	"354C": "00b140",
+	"355C": "009639",
+	"368C": "78be20",
+	"375C": "97d700",
+
+	// Grays, blacks, and metallics
+	"COOLGRAY1C":  "d9d9d6",
+	"COOLGRAY5C":  "b1b3b3",
+	"COOLGRAY7C":  "97999b",
+	"COOLGRAY9C":  "75787b",
+	"COOLGRAY11C": "53565a",
+	"WARMGRAY1C":  "d7d2cb",
+	"425C":        "54585a",
+	"426C":        "25282a",
+	"432C":        "333f48",
+	"433C":        "1d252d",
+	"7547C":       "131e29",
+	"871C":        "84754e",
+	"877C":        "8a8d8f",
+}
+
+// pantoneToColor returns the sRGB approximation of a Pantone color, like
+// "185C", "185 C", or "reflex-blue-c". The C for coated can be left out.
+func pantoneToColor(name string) (color.NRGBA, error) {
+	key := strings.ToUpper(name)
+	key = strings.NewReplacer(" ", "", "-", "", "_", "").Replace(key)
+	hex, ok := pantoneColors[key]
+	if !ok {
+		hex, ok = pantoneColors[key+"C"]
+	}
+	if !ok {
+		return color.NRGBA{}, fmt.Errorf("unknown Pantone color '%s'", name)
+	}
+	return hexToColor(hex)
+}
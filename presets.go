@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// preset is a saved set of flags and a command, used with --preset.
+type preset struct {
+	Flags   []string `json:"flags"`
+	Command []string `json:"command"`
+}
+
+// presetsPath returns the path of the presets file. It can be set with the
+// DIDDER_PRESETS environment variable, and otherwise it's in the user's
+// config directory.
+func presetsPath() (string, error) {
+	if path := os.Getenv("DIDDER_PRESETS"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("couldn't find the presets file: %w", err)
+	}
+	return filepath.Join(dir, "didder", "presets.json"), nil
+}
+
+// loadPreset returns the preset with that name from the presets file.
+func loadPreset(name string) (preset, error) {
+	path, err := presetsPath()
+	if err != nil {
+		return preset{}, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return preset{}, fmt.Errorf("couldn't read presets file: %w", err)
+	}
+	var presets map[string]preset
+	err = json.Unmarshal(b, &presets)
+	if err != nil {
+		return preset{}, fmt.Errorf("couldn't parse presets file '%s': %w", path, err)
+	}
+	p, ok := presets[name]
+	if !ok {
+		return preset{}, fmt.Errorf("no preset named '%s' in '%s'", name, path)
+	}
+	return p, nil
+}
+
+// expandPreset replaces a --preset flag in the args with the flags of the
+// preset. Preset flags that are also set on the command line are left out, so
+// the command line overrides the preset. The preset command is added to the
+// end, unless the args already have a command.
+func expandPreset(args []string, app *cli.App) ([]string, error) {
+	name := ""
+	rest := []string{}
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--preset" {
+			if i+1 == len(args) {
+				return nil, errors.New("no value after --preset flag")
+			}
+			name = args[i+1]
+			i++
+			continue
+		}
+		if strings.HasPrefix(arg, "--preset=") {
+			name = strings.TrimPrefix(arg, "--preset=")
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	if name == "" {
+		return args, nil
+	}
+
+	p, err := loadPreset(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Flags set on the command line, by their first name
+	set := map[string]bool{}
+	for _, arg := range rest {
+		if f := findFlag(arg, app.Flags); f != nil {
+			set[f.Names()[0]] = true
+		}
+	}
+
+	expanded := []string{args[0]}
+	for i := 0; i < len(p.Flags); i++ {
+		f := findFlag(p.Flags[i], app.Flags)
+		if f == nil {
+			return nil, fmt.Errorf("preset '%s': '%s' is not a global flag", name, p.Flags[i])
+		}
+		// Non-bool flags take the next arg as their value, unless it's
+		// given with '='
+		n := 1
+		if _, isBool := f.(*cli.BoolFlag); !isBool && !strings.Contains(p.Flags[i], "=") {
+			n = 2
+		}
+		if i+n > len(p.Flags) {
+			return nil, fmt.Errorf("preset '%s': no value after '%s'", name, p.Flags[i])
+		}
+		if !set[f.Names()[0]] {
+			expanded = append(expanded, p.Flags[i:i+n]...)
+		}
+		i += n - 1
+	}
+	expanded = append(expanded, rest...)
+	if argsCommand(rest, app) == nil {
+		expanded = append(expanded, p.Command...)
+	}
+	return expanded, nil
+}
+
+// findFlag returns the flag that arg sets, like "--palette" or "-p=red", or
+// nil if arg isn't one of the flags.
+func findFlag(arg string, flags []cli.Flag) cli.Flag {
+	if !strings.HasPrefix(arg, "-") {
+		return nil
+	}
+	arg = strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+	for _, f := range flags {
+		for _, name := range f.Names() {
+			if name == arg {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// argsCommand returns the command given in the args, which don't include the
+// program name, or nil if there isn't one. The args are parsed by cli with
+// the global flags of a new app, so a flag value like "-o edm" isn't mistaken
+// for a command.
+func argsCommand(args []string, app *cli.App) *cli.Command {
+	name := ""
+	parser := newApp()
+	parser.Commands = nil
+	parser.Before, parser.After = nil, nil
+	parser.HideHelp = true
+	parser.Writer, parser.ErrWriter = io.Discard, io.Discard
+	parser.OnUsageError = func(c *cli.Context, err error, isSubcommand bool) error {
+		return err
+	}
+	parser.Action = func(c *cli.Context) error {
+		name = c.Args().First()
+		return nil
+	}
+	// Errors are reported when the args are run for real
+	parser.Run(append([]string{app.Name}, args...))
+	return app.Command(name)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+
+	"github.com/urfave/cli/v2"
+)
+
+// previewWidth returns the width of the terminal in characters, using the
+// COLUMNS environment variable. It defaults to 80.
+func previewWidth() int {
+	cols, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || cols <= 0 {
+		return 80
+	}
+	return cols
+}
+
+// printPreview prints the image to stdout using ANSI 24-bit color escape codes.
+// Each character is two pixels, with the upper half block character showing
+// the top pixel in the foreground color and the bottom one in the background
+// color. Images wider than the terminal are shrunk with nearest-neighbor
+// scaling, which will distort the dithering pattern but shows the overall look.
+func printPreview(img image.Image) error {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// Scale factor, as a fraction of pixels
+	outW := w
+	if cols := previewWidth(); outW > cols {
+		outW = cols
+	}
+	outH := h * outW / w
+	if outH < 1 {
+		outH = 1
+	}
+	at := func(x, y int) color.NRGBA {
+		return color.NRGBAModel.Convert(img.At(b.Min.X+x*w/outW, b.Min.Y+y*h/outH)).(color.NRGBA)
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+	for y := 0; y < outH; y += 2 {
+		for x := 0; x < outW; x++ {
+			top := at(x, y)
+			if y+1 < outH {
+				bottom := at(x, y+1)
+				fmt.Fprintf(bw, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm▀",
+					top.R, top.G, top.B, bottom.R, bottom.G, bottom.B)
+			} else {
+				// Odd number of rows, so the last row only has the top half
+				fmt.Fprintf(bw, "\x1b[38;2;%d;%d;%dm\x1b[49m▀", top.R, top.G, top.B)
+			}
+		}
+		// Reset colors before the newline, so they don't fill the rest of the line
+		bw.WriteString("\x1b[0m\n")
+	}
+	return bw.Flush()
+}
+
+// openInViewer opens the path with the default program for it, without
+// waiting for it to close.
+func openInViewer(path string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", path)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", path)
+	default:
+		cmd = exec.Command("xdg-open", path)
+	}
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// withPreviewOpen opens the output in the default viewer after f is done, if
+// --preview-open was used and f worked.
+func withPreviewOpen(f func(c *cli.Context) error) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		err := f(c)
+		if err == nil && previewOpenPath != "" {
+			if openErr := openInViewer(previewOpenPath); openErr != nil {
+				warn("couldn't open '%s' in a viewer: %v", previewOpenPath, openErr)
+			}
+		}
+		return err
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"strings"
+)
+
+// reportEntry is the result of processing one input image, for --json-report.
+type reportEntry struct {
+	Input       string   `json:"input"`
+	Outputs     []string `json:"outputs"`
+	Formats     []string `json:"formats"`
+	Width       int      `json:"width"`
+	Height      int      `json:"height"`
+	PaletteSize int      `json:"palette_size"`
+	Success     bool     `json:"success"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// jsonReport is the whole report written by --json-report.
+type jsonReport struct {
+	Images []*reportEntry `json:"images"`
+	// Error is the error the run ended with, if any
+	Error string `json:"error,omitempty"`
+}
+
+var (
+	// jsonReportPath is where the report is written, or empty if there's no
+	// report
+	jsonReportPath string
+
+	report jsonReport
+
+	// reportUsage is set by --report-usage, to print how much each palette
+	// color was used
+	reportUsage bool
+)
+
+// addReportEntry adds an entry for the input image to the report, and
+// returns it so it can be filled in.
+func addReportEntry(input string) *reportEntry {
+	entry := &reportEntry{
+		Input:       input,
+		Outputs:     make([]string, 0),
+		Formats:     make([]string, 0),
+		PaletteSize: len(palette),
+	}
+	report.Images = append(report.Images, entry)
+	return entry
+}
+
+// writeReport writes the report as JSON to jsonReportPath. runErr is the
+// error that processing ended with, which can be nil.
+func writeReport(runErr error) error {
+	if runErr != nil {
+		report.Error = runErr.Error()
+		// The image being processed when it stopped
+		if n := len(report.Images); n > 0 && !report.Images[n-1].Success && report.Images[n-1].Error == "" {
+			report.Images[n-1].Error = runErr.Error()
+		}
+	}
+	if report.Images == nil {
+		report.Images = make([]*reportEntry, 0)
+	}
+
+	b, err := json.MarshalIndent(&report, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(jsonReportPath, append(b, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing JSON report: %w", err)
+	}
+	return nil
+}
+
+// setFrame fills in the entry for an animated GIF frame.
+func (e *reportEntry) setFrame(frame image.Image) {
+	e.Outputs = append(e.Outputs, outPath)
+	e.Formats = append(e.Formats, "gif")
+	e.Width, e.Height = frame.Bounds().Dx(), frame.Bounds().Dy()
+	e.Success = true
+}
+
+// paletteUsage counts how many pixels of the dithered image use each color of
+// the palette. Paletted images are counted by index. Other images are matched
+// to the palette by RGB, and fully transparent pixels aren't counted.
+func paletteUsage(img image.Image, pal []color.Color) []int {
+	b := img.Bounds()
+	if p, ok := img.(*image.Paletted); ok {
+		counts := make([]int, len(p.Palette))
+		for y := 0; y < b.Dy(); y++ {
+			for _, index := range p.Pix[y*p.Stride : y*p.Stride+b.Dx()] {
+				counts[index]++
+			}
+		}
+		return counts
+	}
+
+	counts := make([]int, len(pal))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.At(x, y)
+			if _, _, _, a := c.RGBA(); a == 0 {
+				continue
+			}
+			for i := range pal {
+				if sameRGB(c, pal[i]) {
+					counts[i]++
+					break
+				}
+			}
+		}
+	}
+	return counts
+}
+
+// printUsage prints a histogram of the palette colors used in the dithered
+// image to stderr, for --report-usage.
+func printUsage(name string, img image.Image, pal []color.Color) {
+	if p, ok := img.(*image.Paletted); ok {
+		pal = ditheredPalette(p)
+	}
+	// Pixels kept transparent by --keep-transparency aren't counted
+	counts := paletteUsage(img, pal)[:len(pal)]
+
+	total := 0
+	used := 0
+	for _, n := range counts {
+		total += n
+		if n > 0 {
+			used++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d of %d palette colors used\n", name, used, len(pal))
+
+	const barWidth = 40
+	for i, n := range counts {
+		percent := 0.0
+		if total > 0 {
+			percent = float64(n) / float64(total) * 100
+		}
+		bar := strings.Repeat("#", int(percent/100*barWidth+0.5))
+		line := fmt.Sprintf("  %-9s %10d %6.2f%% %s", colorToHex(pal[i]), n, percent, bar)
+		fmt.Fprintln(os.Stderr, strings.TrimRight(line, " "))
+	}
+}
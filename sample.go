@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"sort"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// sampleMethods maps palette sampling method names to their functions. Each
+// function takes the colors of the image and returns up to n colors.
+var sampleMethods = map[string]func(pixels []color.NRGBA, n int) []color.Color{
+	"median-cut": medianCut,
+	"popularity": popularity,
+}
+
+// maxSamplePixels is the maximum number of pixels used for sampling. Larger
+// images are evenly subsampled, which is much faster and barely changes the
+// result.
+const maxSamplePixels = 1 << 18
+
+// sampleMethod parses a palette argument like "sample" or "sample:median-cut".
+// It returns the method name, and false if the argument isn't a sample one.
+func sampleMethod(arg string) (string, bool) {
+	arg = strings.ToLower(strings.TrimSpace(arg))
+	if arg == "sample" {
+		return "median-cut", true
+	}
+	if strings.HasPrefix(arg, "sample:") {
+		return strings.TrimPrefix(arg, "sample:"), true
+	}
+	return "", false
+}
+
+// extractInputPalette returns a palette sampled from the input image at the
+// provided index, using paletteSampleMethod and sampleColors.
+func extractInputPalette(i int) ([]color.Color, error) {
+	sampler, ok := sampleMethods[paletteSampleMethod]
+	if !ok {
+		return nil, fmt.Errorf("invalid palette sampling method '%s'", paletteSampleMethod)
+	}
+	if sampleColors < 2 {
+		return nil, errors.New("--sample-colors must be at least 2")
+	}
+	if i >= len(inputImages) {
+		return nil, errors.New("there are no input images to sample the palette from")
+	}
+	if inputImages[i] == "-" {
+		return nil, errors.New("the palette can't be sampled from standard input")
+	}
+	return samplePalette(inputImages[i], sampler, sampleColors)
+}
+
+// isGrayPalette returns true if every color in the palette is a shade of gray.
+func isGrayPalette(pal []color.Color) bool {
+	for _, c := range pal {
+		r, g, b, _ := c.RGBA()
+		if r != g || g != b {
+			return false
+		}
+	}
+	return true
+}
+
+// samplePalette loads the image at path and samples up to n colors from it.
+func samplePalette(path string, sampler func([]color.NRGBA, int) []color.Color, n int) ([]color.Color, error) {
+	img, err := loadImage(path)
+	if err != nil {
+		return nil, fmt.Errorf("error loading '%s' to sample palette: %w", path, err)
+	}
+	nrgba := imaging.Clone(img)
+
+	total := nrgba.Rect.Dx() * nrgba.Rect.Dy()
+	step := 1
+	for total/step > maxSamplePixels {
+		step++
+	}
+
+	pixels := make([]color.NRGBA, 0, total/step+1)
+	for i := 0; i < total; i += step {
+		p := nrgba.Pix[i*4 : i*4+4 : i*4+4]
+		if p[3] < 128 {
+			// Mostly transparent pixels don't contribute their color
+			continue
+		}
+		pixels = append(pixels, color.NRGBA{p[0], p[1], p[2], 255})
+	}
+	if len(pixels) == 0 {
+		return nil, fmt.Errorf("no opaque pixels in '%s' to sample palette from", path)
+	}
+	return sampler(pixels, n), nil
+}
+
+// medianCut returns up to n colors that represent the pixels, using the
+// median cut algorithm. The box with the widest channel range is repeatedly
+// split at its median, and each final box is averaged into a color.
+func medianCut(pixels []color.NRGBA, n int) []color.Color {
+	// Each box is a slice of pixels, and they all share the same backing array
+	boxes := [][]color.NRGBA{pixels}
+
+	for len(boxes) < n {
+		// Find the box and channel with the widest range
+		best, bestCh, bestRange := -1, 0, 0
+		for i, box := range boxes {
+			ch, r := widestChannel(box)
+			if r > bestRange {
+				best, bestCh, bestRange = i, ch, r
+			}
+		}
+		if best == -1 {
+			// Every box is a single color, so no more colors can be found
+			break
+		}
+
+		box := boxes[best]
+		sort.Slice(box, func(i, j int) bool {
+			return channel(box[i], bestCh) < channel(box[j], bestCh)
+		})
+		// Split at the median, but never in the middle of a run of equal
+		// values, so both halves are non-empty and distinct
+		mid := len(box) / 2
+		v := channel(box[mid], bestCh)
+		for mid > 0 && channel(box[mid-1], bestCh) == v {
+			mid--
+		}
+		if mid == 0 {
+			for mid < len(box) && channel(box[mid], bestCh) == v {
+				mid++
+			}
+		}
+		boxes[best] = box[:mid]
+		boxes = append(boxes, box[mid:])
+	}
+
+	colors := make([]color.Color, len(boxes))
+	for i, box := range boxes {
+		var r, g, b int
+		for _, p := range box {
+			r += int(p.R)
+			g += int(p.G)
+			b += int(p.B)
+		}
+		l := len(box)
+		colors[i] = color.NRGBA{uint8((r + l/2) / l), uint8((g + l/2) / l), uint8((b + l/2) / l), 255}
+	}
+	return colors
+}
+
+// popularity returns up to n colors that represent the pixels, by picking the
+// most common ones. Colors are grouped with 5 bits per channel first, so that
+// slightly different shades count as the same color, and each group is
+// averaged into a color.
+func popularity(pixels []color.NRGBA, n int) []color.Color {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := make(map[int]*bucket)
+	for _, p := range pixels {
+		key := int(p.R>>3)<<10 | int(p.G>>3)<<5 | int(p.B>>3)
+		bk, ok := buckets[key]
+		if !ok {
+			bk = &bucket{}
+			buckets[key] = bk
+		}
+		bk.count++
+		bk.r += int(p.R)
+		bk.g += int(p.G)
+		bk.b += int(p.B)
+	}
+
+	keys := make([]int, 0, len(buckets))
+	for key := range buckets {
+		keys = append(keys, key)
+	}
+	// Most common first, and by key for ties so the result doesn't change
+	// between runs
+	sort.Slice(keys, func(i, j int) bool {
+		ci, cj := buckets[keys[i]].count, buckets[keys[j]].count
+		if ci != cj {
+			return ci > cj
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+
+	colors := make([]color.Color, len(keys))
+	for i, key := range keys {
+		bk := buckets[key]
+		l := bk.count
+		colors[i] = color.NRGBA{uint8((bk.r + l/2) / l), uint8((bk.g + l/2) / l), uint8((bk.b + l/2) / l), 255}
+	}
+	return colors
+}
+
+// widestChannel returns the index (0-2 for RGB) of the channel with the
+// widest range of values in the pixels, and that range.
+func widestChannel(pixels []color.NRGBA) (int, int) {
+	lo := [3]int{255, 255, 255}
+	hi := [3]int{0, 0, 0}
+	for _, p := range pixels {
+		for ch := 0; ch < 3; ch++ {
+			v := channel(p, ch)
+			if v < lo[ch] {
+				lo[ch] = v
+			}
+			if v > hi[ch] {
+				hi[ch] = v
+			}
+		}
+	}
+	best := 0
+	for ch := 1; ch < 3; ch++ {
+		if hi[ch]-lo[ch] > hi[best]-lo[best] {
+			best = ch
+		}
+	}
+	return best, hi[best] - lo[best]
+}
+
+func channel(p color.NRGBA, ch int) int {
+	switch ch {
+	case 0:
+		return int(p.R)
+	case 1:
+		return int(p.G)
+	}
+	return int(p.B)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// separationsDir is the directory --separations writes a mask for each
+// palette color to, or empty if there are no separations.
+var separationsDir string
+
+// separationPalette is the palette of separation masks. Index 1 is where the
+// color is used, like ink on film for screen printing.
+var separationPalette = color.Palette{color.White, color.Black}
+
+// separationMasks returns a 1-bit mask for each palette color, which is black
+// where the dithered image uses that color, and white everywhere else. Images
+// that aren't paletted are matched to the palette by RGB, and fully
+// transparent pixels aren't part of any mask. Paletted images must use pal.
+func separationMasks(img image.Image, pal []color.Color) []*image.Paletted {
+	b := img.Bounds()
+	p, isPaletted := img.(*image.Paletted)
+	masks := make([]*image.Paletted, len(pal))
+	for i := range masks {
+		masks[i] = image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), separationPalette)
+	}
+
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			index := -1
+			if isPaletted {
+				index = int(p.ColorIndexAt(b.Min.X+x, b.Min.Y+y))
+			} else {
+				c := img.At(b.Min.X+x, b.Min.Y+y)
+				if _, _, _, a := c.RGBA(); a != 0 {
+					for i := range pal {
+						if sameRGB(c, pal[i]) {
+							index = i
+							break
+						}
+					}
+				}
+			}
+			// Reserved GIF entries come after the palette colors, and
+			// aren't part of any mask
+			if index != -1 && index < len(masks) {
+				masks[index].SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	return masks
+}
+
+// writeSeparations writes a separation mask PNG for each palette color of the
+// dithered image to separationsDir. The files are named after the input image,
+// with the index and hex code of the color, like "photo-2-ff0000.png". If
+// --recolor is used, the hex code is of the recolor color.
+func writeSeparations(name string, img image.Image, pal []color.Color) error {
+	if p, ok := img.(*image.Paletted); ok {
+		pal = ditheredPalette(p)
+	}
+	masks := separationMasks(img, pal)
+	digits := len(strconv.Itoa(len(masks) - 1))
+	for i, mask := range masks {
+		c := pal[i]
+		if len(recolorPalette) == len(masks) {
+			c = recolorPalette[i]
+		}
+		hex := strings.TrimPrefix(colorToHex(c), "#")
+		path := filepath.Join(separationsDir, fmt.Sprintf("%s-%0*d-%s.png", name, digits, i, hex))
+
+		file, path, err := openOutFile(path)
+		if err != nil {
+			return err
+		}
+		err = (&png.Encoder{CompressionLevel: compLevel}).Encode(file, resizeOutput(mask))
+		if err != nil {
+			defer file.Abort()
+			return fmt.Errorf("error writing separation to '%s': %w", path, err)
+		}
+		err = file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// separationName returns the name separations of the input image at index i
+// are written under, without an extension.
+func separationName(inputPath string, i int) string {
+	name := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
+	if numberFrames {
+		name = frameName(i)
+	} else if inputPath == "-" {
+		name = "stdin"
+	}
+	return name + sizeSuffix
+}
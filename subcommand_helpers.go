@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
@@ -9,16 +12,23 @@ import (
 	"image/gif"
 	"image/png"
 	"io"
+	"io/fs"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/disintegration/imaging"
+	"github.com/makeworld-the-better-one/didder/pkg/didder"
 	"github.com/makeworld-the-better-one/dither/v2"
 	"github.com/urfave/cli/v2"
-	"golang.org/x/image/colornames"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
 )
 
 // parsePercentArg takes a string like "0.5" or "50%" and will return a float
@@ -47,6 +57,40 @@ func parsePercentArg(arg string, maxOne bool) (float64, error) {
 	return f64, err
 }
 
+// parseStrength parses a strength argument with parsePercentArg. Unlike
+// parsePercentArg an empty string is an error, so that a strength of zero is
+// only used when it's asked for.
+func parseStrength(arg string) (float32, error) {
+	if arg == "" {
+		return 0, errors.New("no value given")
+	}
+	f64, err := parsePercentArg(arg, true)
+	return float32(f64), err
+}
+
+// readStdinJSON decodes JSON from stdin into v, for custom matrices given as
+// "-". Stdin is only read the first time, so the same matrix can be used by
+// several algorithms.
+func readStdinJSON(v interface{}) error {
+	for _, path := range inputImages {
+		if path == "-" {
+			return errors.New("the matrix and an input image can't both be read from stdin")
+		}
+	}
+	if stdinJSON == nil {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("error reading matrix from stdin: %w", err)
+		}
+		stdinJSON = b
+	}
+	err := json.Unmarshal(stdinJSON, v)
+	if err != nil {
+		return fmt.Errorf("couldn't parse matrix JSON from stdin: %w", err)
+	}
+	return nil
+}
+
 // globalFlag returns the value of flag at the top level of the command.
 // For example, with the command:
 //     dither --threads 1 edm -s Simple2D
@@ -88,119 +132,496 @@ func parseArgs(args []string, splitRunes string) []string {
 	return finalArgs
 }
 
-func hexToColor(hex string) (color.NRGBA, error) {
-	// Modified from https://github.com/lucasb-eyer/go-colorful/blob/v1.2.0/colors.go#L333
+// parseFrameRange parses a frame selector like "10:50", "10:", or "0::2" and
+// returns the start (inclusive), end (exclusive), and step values for a list
+// of n frames. Omitted values default to the start of the list, the end of the
+// list, and 1 respectively. The end value is clamped to n.
+func parseFrameRange(arg string, n int) (int, int, int, error) {
+	parts := strings.Split(arg, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, 0, 0, fmt.Errorf("'%s' is not a valid range. Example: 10:50", arg)
+	}
 
-	hex = strings.TrimPrefix(hex, "#")
+	vals := []int{0, n, 1}
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		v, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("'%s' is not a valid range. Example: 10:50", arg)
+		}
+		if v < 0 {
+			return 0, 0, 0, errors.New("range values can't be negative")
+		}
+		vals[i] = v
+	}
+	start, end, step := vals[0], vals[1], vals[2]
 
-	format := "%02x%02x%02x"
-	var r, g, b uint8
-	n, err := fmt.Sscanf(strings.ToLower(hex), format, &r, &g, &b)
-	if err != nil {
-		return color.NRGBA{}, err
+	if step == 0 {
+		return 0, 0, 0, errors.New("range step can't be 0")
 	}
-	if n != 3 {
-		return color.NRGBA{}, fmt.Errorf("%s is not a hex color", hex)
+	if end > n {
+		end = n
 	}
-	return color.NRGBA{r, g, b, 255}, nil
+	if start >= end {
+		return 0, 0, 0, fmt.Errorf("range '%s' selects no frames out of %d", arg, n)
+	}
+	return start, end, step, nil
 }
 
-func rgbToColor(s string) (color.NRGBA, error) {
-	format := "%d,%d,%d"
-	var r, g, b uint8
-	n, err := fmt.Sscanf(s, format, &r, &g, &b)
-	if err != nil {
-		return color.NRGBA{}, err
-	}
-	if n != 3 {
-		return color.NRGBA{}, fmt.Errorf("%s is not an RGB tuple", s)
+// colorIndex returns the index of the first palette color with the same RGB
+// values, or -1. Alpha is ignored.
+func colorIndex(p []color.Color, c color.NRGBA) int {
+	for i := range p {
+		if sameRGB(p[i], c) {
+			return i
+		}
 	}
-	return color.NRGBA{r, g, b, 255}, nil
+	return -1
 }
 
-func rgbaToColor(s string) (color.NRGBA, error) {
-	format := "%d,%d,%d,%d"
-	var r, g, b, a uint8
-	n, err := fmt.Sscanf(s, format, &r, &g, &b, &a)
-	if err != nil {
-		return color.NRGBA{}, err
-	}
-	if n != 4 {
-		return color.NRGBA{}, fmt.Errorf("%s is not an RGBA tuple", s)
+// lightestColor returns the index of the lightest color of the palette.
+func lightestColor(p []color.Color) int {
+	light := 0
+	var lightLum uint16
+	for i := range p {
+		lum := color.Gray16Model.Convert(p[i]).(color.Gray16).Y
+		if lum > lightLum {
+			light, lightLum = i, lum
+		}
 	}
-	// Parse as non-premult, as that's more user-friendly
-	return color.NRGBA{r, g, b, a}, nil
+	return light
 }
 
-// parseColors takes args and turns them into a color slice. All returned
-// colors are guaranteed to only be color.NRGBA.
-func parseColors(flag string, c *cli.Context) ([]color.Color, error) {
-	args := parseArgs([]string{globalFlag(flag, c).(string)}, " ")
-	colors := make([]color.Color, len(args))
+// warn prints a warning to stderr, so it doesn't mix with image output on
+// stdout.
+func warn(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "warning: "+format+"\n", a...)
+}
+
+// sameRGB returns true if the colors have the same RGB values, ignoring alpha.
+func sameRGB(a, b color.Color) bool {
+	ac := color.NRGBAModel.Convert(a).(color.NRGBA)
+	bc := color.NRGBAModel.Convert(b).(color.NRGBA)
+	return ac.R == bc.R && ac.G == bc.G && ac.B == bc.B
+}
 
-	for i, arg := range args {
-		// Try to parse as RGB numbers, then hex, then grayscale, then SVG colors, then fail
-		// Optionally try for RGBA if it's recolor, see #1
+// containsString returns true if the string is in the slice.
+func containsString(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
 
-		if strings.Count(arg, ",") == 2 {
-			rgbColor, err := rgbToColor(arg)
+// sortPaths sorts the paths in place by the --sort type, which must be valid.
+func sortPaths(paths []string, sortType string) {
+	switch sortType {
+	case "name":
+		sort.Strings(paths)
+	case "natural":
+		sort.SliceStable(paths, func(i, j int) bool {
+			return naturalLess(paths[i], paths[j])
+		})
+	case "mtime":
+		modTimes := make(map[string]time.Time, len(paths))
+		for _, path := range paths {
+			fi, err := os.Stat(path)
 			if err != nil {
-				return nil, fmt.Errorf("%s: %s is not a valid RGB tuple. Example: 25,200,150", flag, arg)
+				// Sort before everything else
+				continue
 			}
-			colors[i] = rgbColor
-			continue
+			modTimes[path] = fi.ModTime()
+		}
+		sort.SliceStable(paths, func(i, j int) bool {
+			return modTimes[paths[i]].Before(modTimes[paths[j]])
+		})
+	}
+}
+
+// naturalLess compares two strings in a numeric-aware way, so that runs of
+// digits are compared by their value. For example "frame2.png" comes before
+// "frame10.png".
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		aDigits := strings.IndexFunc(a, func(r rune) bool { return r < '0' || r > '9' })
+		if aDigits == -1 {
+			aDigits = len(a)
+		}
+		bDigits := strings.IndexFunc(b, func(r rune) bool { return r < '0' || r > '9' })
+		if bDigits == -1 {
+			bDigits = len(b)
 		}
 
-		if flag == "recolor" && strings.Count(arg, ",") == 3 {
-			rgbaColor, err := rgbaToColor(arg)
-			if err != nil {
-				return nil, fmt.Errorf("%s: %s is not a valid RGBA tuple. Example: 25,200,150,100", flag, arg)
+		if aDigits > 0 && bDigits > 0 {
+			// Both start with a number, compare those numbers
+			aNum := strings.TrimLeft(a[:aDigits], "0")
+			bNum := strings.TrimLeft(b[:bDigits], "0")
+			if len(aNum) != len(bNum) {
+				return len(aNum) < len(bNum)
 			}
-			colors[i] = rgbaColor
+			if aNum != bNum {
+				return aNum < bNum
+			}
+			a, b = a[aDigits:], b[bDigits:]
 			continue
 		}
 
-		hexColor, err := hexToColor(arg)
-		if err == nil {
-			colors[i] = hexColor
-			continue
+		if a[0] != b[0] {
+			return a[0] < b[0]
 		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
 
-		n, err := strconv.Atoi(arg)
-		if err == nil {
-			if n > 255 || n < 0 {
-				return nil, fmt.Errorf("%s: single numbers like %d must be in the range 0-255", flag, n)
+// preflight checks that every input image can be opened and looks like a
+// supported image, by reading its header. All the problems are reported in
+// one error.
+func preflight(paths []string) error {
+	problems := make([]string, 0)
+	var first error // Kept for the exit code
+	for _, path := range paths {
+		if path == "-" {
+			continue
+		}
+		if rawInputSize.X != 0 {
+			fi, err := os.Stat(path)
+			if err != nil {
+				problems = append(problems, err.Error())
+				if first == nil {
+					first = err
+				}
+			} else if fi.Size() != rawImageBytes() {
+				problems = append(problems, fmt.Sprintf("%s: raw image is %d bytes, but should be %d", path, fi.Size(), rawImageBytes()))
+			}
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			problems = append(problems, err.Error())
+			if first == nil {
+				first = err
 			}
-			colors[i] = color.NRGBA{uint8(n), uint8(n), uint8(n), 255}
 			continue
 		}
+		_, _, err = image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", path, err))
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return summaryError{
+			fmt.Sprintf("%d of %d input images can't be read:\n%s", len(problems), len(paths), strings.Join(problems, "\n")),
+			first,
+		}
+	}
+	return nil
+}
+
+// outputPixels returns the number of pixels the output image for the input
+// path will have, after resizing, upscaling, and padding. Only the image
+// header is read. Standard input can't be checked, so it returns an error.
+func outputPixels(path string) (uint64, error) {
+	if path == "-" {
+		return 0, errors.New("can't check standard input")
+	}
+	var cfg image.Config
+	if rawInputSize.X != 0 {
+		cfg.Width, cfg.Height = rawInputSize.X, rawInputSize.Y
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		cfg, _, err = image.DecodeConfig(f)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	w, h := cfg.Width, cfg.Height
+	if width != 0 || height != 0 {
+		// Same as imaging.Resize, which keeps the aspect ratio if one is 0
+		nw, nh := width, height
+		if nw == 0 {
+			nw = int(math.Max(1, math.Round(float64(w)*float64(nh)/float64(h))))
+		}
+		if nh == 0 {
+			nh = int(math.Max(1, math.Round(float64(h)*float64(nw)/float64(w))))
+		}
+		w, h = nw, nh
+	}
+	if pixelSize > 1 {
+		w = int(math.Max(math.Round(float64(w)/float64(pixelSize)), 1))
+		h = int(math.Max(math.Round(float64(h)/float64(pixelSize)), 1))
+	}
+	ow, oh := uint64(w)*uint64(upscaleX), uint64(h)*uint64(upscaleY)
+	if matchInputSize {
+		ow, oh = uint64(cfg.Width), uint64(cfg.Height)
+	}
+	if tileSize.X != 0 {
+		ow, oh = uint64(tileSize.X), uint64(tileSize.Y)
+	}
+	// Border on each side
+	ow += uint64(padding) * 2
+	oh += uint64(padding) * 2
+	n := ow * oh
+	if compare {
+		// Original is next to the output
+		n *= 2
+	}
+	return n, nil
+}
+
+// parseUpscale parses an upscale factor like "2", or separate X and Y factors
+// like "2x3".
+func parseUpscale(arg string) (int, int, error) {
+	parts := strings.Split(strings.ToLower(arg), "x")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("'%s' is not a scale factor. Examples: 2, 2x3", arg)
+	}
+	factors := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("'%s' is not a scale factor, only positive integers are allowed. Examples: 2, 2x3", arg)
+		}
+		if n == 0 {
+			// Invalid, but it always has been ignored
+			n = 1
+		}
+		factors[i] = n
+	}
+	if len(factors) == 1 {
+		return factors[0], factors[0], nil
+	}
+	return factors[0], factors[1], nil
+}
+
+// parseSize parses a size like "1920x1080".
+func parseSize(arg string) (image.Point, error) {
+	parts := strings.Split(strings.ToLower(arg), "x")
+	if len(parts) != 2 {
+		return image.Point{}, fmt.Errorf("'%s' is not a size. Example: 1920x1080", arg)
+	}
+	w, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	h, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil || w < 1 || h < 1 {
+		return image.Point{}, fmt.Errorf("'%s' is not a size, only positive integers are allowed. Example: 1920x1080", arg)
+	}
+	return image.Point{w, h}, nil
+}
+
+// parseRecolorMap parses a list of comma-separated replacements like
+// "black=navy,ffffff=ivory" and returns a recolor palette. Palette colors
+// that aren't replaced are recolored to themselves.
+func parseRecolorMap(arg string) ([]color.Color, error) {
+	colors := make([]color.Color, len(palette))
+	copy(colors, palette)
 
-		htmlColor, ok := colornames.Map[strings.ToLower(arg)]
-		if ok {
-			colors[i] = color.NRGBAModel.Convert(htmlColor).(color.NRGBA)
+	for _, pair := range strings.Split(arg, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
 			continue
 		}
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("recolor-map: '%s' is not a replacement. Example: black=navy", pair)
+		}
+		from, err := parseColor("recolor-map", strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseColor("recolor-map", strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		if colorIndex(palette, from) == -1 {
+			return nil, fmt.Errorf("recolor-map: %s is not one of the palette colors", parts[0])
+		}
+		// Replace every copy, in case the palette has the color more than once
+		for i := range palette {
+			if sameRGB(palette[i], from) {
+				colors[i] = to
+			}
+		}
+	}
+	return colors, nil
+}
+
+// linearize converts an sRGB value in the range [0, 1] to linear RGB.
+func linearize(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// delinearize converts a linear RGB value in the range [0, 1] to sRGB.
+func delinearize(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
 
-		return nil, fmt.Errorf("%s: %s not recognized as an RGB tuple, hex code, number 0-255, or SVG color name", flag, arg)
+// invertColors returns a copy of the colors with their RGB values inverted.
+// Alpha is not changed.
+func invertColors(colors []color.Color) []color.Color {
+	inverted := make([]color.Color, len(colors))
+	for i, c := range colors {
+		nc := c.(color.NRGBA)
+		inverted[i] = color.NRGBA{255 - nc.R, 255 - nc.G, 255 - nc.B, nc.A}
 	}
+	return inverted
+}
 
+// parseColors parses the colors of a color flag, like --palette. All returned
+// colors are guaranteed to only be color.NRGBA. Errors are prefixed with the
+// flag name.
+func parseColors(flag string, c *cli.Context) ([]color.Color, error) {
+	colors, err := didder.ParseColors(globalFlag(flag, c).(string), rampSpace, flag == "recolor" || flag == "palette")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", flag, err)
+	}
 	return colors, nil
 }
 
+// parseColor parses a single color argument. Errors are prefixed with the
+// flag name.
+func parseColor(flag, arg string) (color.NRGBA, error) {
+	c, err := didder.ParseColor(arg, flag == "recolor" || flag == "palette")
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("%s: %w", flag, err)
+	}
+	return c, nil
+}
+
 // getInputImage takes an input image arg and returns an image that has
 // modifications applied.
 func getInputImage(arg string, c *cli.Context) (image.Image, error) {
-	var img image.Image
-	var err error
+	img, err := loadImage(arg)
+	if err != nil {
+		return nil, err
+	}
+	return prepareImage(img), nil
+}
 
+// loadImage decodes an input image, with no modifications.
+func loadImage(arg string) (image.Image, error) {
+	inputLoaded = true
+	if rawInputSize.X != 0 {
+		return loadRawImage(arg)
+	}
+	if colorManaged {
+		return loadManagedImage(arg)
+	}
 	if arg == "-" {
-		img, err = imaging.Decode(os.Stdin, autoOrientation)
-	} else {
-		img, err = imaging.Open(arg, autoOrientation)
+		return decodeStdin(os.Stdin)
+	}
+	return imaging.Open(arg, autoOrientation)
+}
+
+// rawPixelSizes maps raw input formats to the number of bytes per pixel.
+var rawPixelSizes = map[string]int{
+	"rgb":  3,
+	"rgba": 4,
+	"gray": 1,
+}
+
+// rawImageBytes returns the number of bytes a raw input image has.
+func rawImageBytes() int64 {
+	return int64(rawInputSize.X) * int64(rawInputSize.Y) * int64(rawPixelSizes[rawInputFormat])
+}
+
+// loadRawImage reads a headerless image, with the size and pixel format set
+// by --input-raw and --input-raw-format. Pixels are read row by row, with
+// 8 bits per channel.
+func loadRawImage(arg string) (image.Image, error) {
+	r := io.Reader(os.Stdin)
+	if arg != "-" {
+		f, err := os.Open(arg)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if fi.Size() != rawImageBytes() {
+			return nil, fmt.Errorf(
+				"raw image is %d bytes, but a %dx%d %s image is %d bytes",
+				fi.Size(), rawInputSize.X, rawInputSize.Y, rawInputFormat, rawImageBytes(),
+			)
+		}
+		r = f
 	}
+
+	buf := make([]byte, rawImageBytes())
+	_, err := io.ReadFull(r, buf)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("couldn't read a %dx%d %s image: %w", rawInputSize.X, rawInputSize.Y, rawInputFormat, err)
+	}
+
+	rect := image.Rect(0, 0, rawInputSize.X, rawInputSize.Y)
+	switch rawInputFormat {
+	case "gray":
+		return &image.Gray{Pix: buf, Stride: rect.Dx(), Rect: rect}, nil
+	case "rgba":
+		return &image.NRGBA{Pix: buf, Stride: rect.Dx() * 4, Rect: rect}, nil
+	}
+	img := image.NewNRGBA(rect)
+	for i := 0; i < len(buf)/3; i++ {
+		copy(img.Pix[i*4:], buf[i*3:i*3+3])
+		img.Pix[i*4+3] = 255
+	}
+	return img, nil
+}
+
+// decodeStdin decodes an image from stdin. The first bytes are kept, so
+// errors can say what was piped in when it's not an image.
+func decodeStdin(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(8)
+	img, err := imaging.Decode(br, autoOrientation)
+	if err == nil {
+		return img, nil
+	}
+
+	if len(magic) == 0 {
+		return nil, errors.New("nothing was read from stdin")
 	}
+	if errors.Is(err, image.ErrFormat) {
+		printable := make([]byte, len(magic))
+		for i, b := range magic {
+			if b < 0x20 || b > 0x7e {
+				b = '.'
+			}
+			printable[i] = b
+		}
+		return nil, formatError{fmt.Errorf("unrecognized image format on stdin, it starts with % x (%q)", magic, printable)}
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("the image on stdin is truncated: %w", err)
+	}
+	return nil, fmt.Errorf("the image on stdin is invalid or truncated: %w", err)
+}
+
+// prepareImage resizes and adjusts a loaded input image, so it's ready to be
+// dithered.
+func prepareImage(img image.Image) image.Image {
+	// Recorded for --match-input-size
+	inputSize = image.Pt(img.Bounds().Dx(), img.Bounds().Dy())
 
 	if width != 0 || height != 0 {
 		// Box sampling is quick and fast, and better then others at downscaling
@@ -210,9 +631,36 @@ func getInputImage(arg string, c *cli.Context) (image.Image, error) {
 		// https://en.wikipedia.org/wiki/Image_scaling#Box_sampling
 		img = imaging.Resize(img, width, height, imaging.Box)
 	}
+	if pixelSize > 1 {
+		// Shrink so that each pixel becomes a block after upscaling
+		b := img.Bounds()
+		img = imaging.Resize(
+			img,
+			int(math.Max(math.Round(float64(b.Dx())/float64(pixelSize)), 1)),
+			int(math.Max(math.Round(float64(b.Dy())/float64(pixelSize)), 1)),
+			imaging.Box,
+		)
+	}
+
+	// Adjustments are applied in this order, it's documented in the manual
 
+	if invert {
+		img = imaging.Invert(img)
+	}
 	if grayscale {
-		img = imaging.Grayscale(img)
+		if grayWeights != nil {
+			img = grayscaleWeighted(img, grayWeights)
+		} else if is16Bit(img) {
+			img = grayscale16(img)
+		} else {
+			img = imaging.Grayscale(img)
+		}
+	}
+	if sepia != 0 {
+		img = sepiaTone(img, sepia)
+	}
+	if autoContrast {
+		img = stretchContrast(img)
 	}
 	if saturation != 0 {
 		img = imaging.AdjustSaturation(img, saturation)
@@ -223,105 +671,450 @@ func getInputImage(arg string, c *cli.Context) (image.Image, error) {
 	if brightness != 0 {
 		img = imaging.AdjustBrightness(img, brightness)
 	}
+	if thresholdCurve != nil {
+		img = applyCurve(img, thresholdCurve)
+	}
 
-	return img, nil
+	return img
 }
 
-// From dither library
+// sepiaTone applies a sepia tone to the image. The amount is in the range
+// [0, 1], where 1 is full sepia and 0 leaves the image unchanged.
+func sepiaTone(img image.Image, amount float64) *image.NRGBA {
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		r, g, b := float64(c.R), float64(c.G), float64(c.B)
 
-func copyImage(dst draw.Image, src image.Image) {
-	draw.Draw(dst, src.Bounds(), src, src.Bounds().Min, draw.Src)
-}
-func copyOfImage(img image.Image) *image.RGBA {
-	dst := image.NewRGBA(img.Bounds())
-	copyImage(dst, img)
-	return dst
-}
+		// Commonly used sepia matrix
+		sr := 0.393*r + 0.769*g + 0.189*b
+		sg := 0.349*r + 0.686*g + 0.168*b
+		sb := 0.272*r + 0.534*g + 0.131*b
 
-///////
+		mix := func(orig, sep float64) uint8 {
+			return uint8(math.Min(math.Round(orig+(sep-orig)*amount), 255))
+		}
+		return color.NRGBA{mix(r, sr), mix(g, sg), mix(b, sb), c.A}
+	})
+}
 
-// recolor will recolor the image pixels if necessary. It should be called
-// before writing any image. It should only be given a dithered image.
-// It will copy an image if it cannot draw on it.
-//
-// If the input image is *image.Paletted, the output will always be of that type too.
-func recolor(src image.Image) image.Image {
-	if len(recolorPalette) == 0 {
-		return src
+// is16Bit returns true if the image holds 16 bits per channel. Those images
+// are dithered directly, to avoid losing precision.
+func is16Bit(img image.Image) bool {
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		return true
 	}
+	return false
+}
 
-	// Modified and returned value
-	var img draw.Image
+// grayscale16 is like imaging.Grayscale, but it keeps 16 bits per channel.
+// The same luminance formula is used, through color.Gray16Model.
+func grayscale16(img image.Image) *image.NRGBA64 {
+	b := img.Bounds()
+	dst := image.NewNRGBA64(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			// Convert the non-premultiplied color, so alpha doesn't affect the gray
+			gray := color.Gray16Model.Convert(color.NRGBA64{c.R, c.G, c.B, 0xffff}).(color.Gray16)
+			dst.SetNRGBA64(x, y, color.NRGBA64{gray.Y, gray.Y, gray.Y, c.A})
+		}
+	}
+	return dst
+}
 
-	// getRecolor takes an image color and returns the recolor one
-	getRecolor := func(a color.Color) color.Color {
-		// palette and recolorPalette are both NRGBA, so use that here too
-		c := color.NRGBAModel.Convert(a).(color.NRGBA)
+// grayscaleMethods maps --grayscale-method values to RGB channel weights.
+var grayscaleMethods = map[string][]float64{
+	"rec601":  {0.299, 0.587, 0.114},
+	"rec709":  {0.2126, 0.7152, 0.0722},
+	"average": {1.0 / 3, 1.0 / 3, 1.0 / 3},
+	"red":     {1, 0, 0},
+	"green":   {0, 1, 0},
+	"blue":    {0, 0, 1},
+}
 
-		for i := range palette {
-			pc := palette[i].(color.NRGBA)
-			if pc.R == c.R && pc.G == c.G && pc.B == c.B {
-				// Colors match. Alpha is ignored because palette colors aren't
-				// allowed alpha, so theirs will always be 255. While the image
-				// might have a different alpha at that point
-				return recolorPalette[i]
-			}
+// grayscaleWeighted makes the image grayscale, using the provided weights
+// for the red, green, and blue channels. 16 bits per channel are kept.
+func grayscaleWeighted(img image.Image, weights []float64) *image.NRGBA64 {
+	b := img.Bounds()
+	dst := image.NewNRGBA64(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			gray := weights[0]*float64(c.R) + weights[1]*float64(c.G) + weights[2]*float64(c.B)
+			v := uint16(math.Min(math.Round(gray), 0xffff))
+			dst.SetNRGBA64(x, y, color.NRGBA64{v, v, v, c.A})
 		}
-		// This should never happen
-		return recolorPalette[0]
 	}
+	return dst
+}
 
-	// Fast path for paletted images
-	if p, ok := src.(*image.Paletted); ok {
-		// For each color in the image palette, replace it with the equivalent
-		// recolor palette color
-		for i, c := range p.Palette {
-			p.Palette[i] = getRecolor(c)
+// levelThresholdCurve returns a curve for applyCurve, that moves the gray
+// value where dithering switches between two palette levels. Normally that's
+// halfway between the levels in linear light, because the closest color is
+// used. The curve maps each threshold to that halfway point, and keeps the
+// levels themselves the same, so pixels at the threshold are dithered half
+// and half. The palette must be grayscale, and the thresholds are sRGB values
+// in the range [0, 1], one between each pair of levels.
+func levelThresholdCurve(pal []color.Color, thresholds []float64) ([]uint16, error) {
+	// Unique levels, darkest first
+	seen := make(map[uint32]bool)
+	levels := make([]float64, 0, len(pal))
+	for _, c := range pal {
+		r, _, _, _ := c.RGBA()
+		if !seen[r] {
+			seen[r] = true
+			levels = append(levels, float64(r)/0xffff)
 		}
-		return p
 	}
+	sort.Float64s(levels)
 
-	var ok bool
-	if img, ok = src.(draw.Image); !ok {
-		// Can't be changed
-		// Instead make a copy and recolor and return that
-		img = copyOfImage(src)
+	if len(thresholds) != len(levels)-1 {
+		return nil, fmt.Errorf("there must be one threshold between each pair of gray levels in the palette, %d in total, but got %d",
+			len(levels)-1, len(thresholds))
 	}
 
-	// Swap each image pixel
+	// Points of the curve in linear light, from input to output value
+	xs := []float64{linearize(levels[0])}
+	ys := []float64{linearize(levels[0])}
+	for i, t := range thresholds {
+		if t <= levels[i] || t >= levels[i+1] {
+			return nil, fmt.Errorf("threshold %d must be between the gray levels %.1f%% and %.1f%%",
+				i+1, levels[i]*100, levels[i+1]*100)
+		}
+		lo := linearize(levels[i])
+		hi := linearize(levels[i+1])
+		xs = append(xs, linearize(t), hi)
+		ys = append(ys, (lo+hi)/2, hi)
+	}
+
+	curve := make([]uint16, 0x10000)
+	for v := range curve {
+		lin := linearize(float64(v) / 0xffff)
+		if lin <= xs[0] || lin >= xs[len(xs)-1] {
+			// Outside the palette range, nothing changes
+			curve[v] = uint16(v)
+			continue
+		}
+		i := sort.SearchFloat64s(xs, lin)
+		// xs[i-1] < lin <= xs[i]
+		frac := (lin - xs[i-1]) / (xs[i] - xs[i-1])
+		out := ys[i-1] + (ys[i]-ys[i-1])*frac
+		curve[v] = uint16(math.Round(delinearize(out) * 0xffff))
+	}
+	return curve, nil
+}
 
+// applyCurve maps each color channel of the image through the curve, which
+// has a value for every 16-bit input.
+func applyCurve(img image.Image, curve []uint16) *image.NRGBA64 {
 	b := img.Bounds()
+	dst := image.NewNRGBA64(b)
 	for y := b.Min.Y; y < b.Max.Y; y++ {
 		for x := b.Min.X; x < b.Max.X; x++ {
-			// Image pixel -> convert to RGBA -> find recolor palette color using map
-			// -> set color
-			img.Set(x, y, getRecolor(img.At(x, y)))
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			dst.SetNRGBA64(x, y, color.NRGBA64{curve[c.R], curve[c.G], curve[c.B], c.A})
 		}
 	}
-	return img
+	return dst
 }
 
-// postProcImage post-processes the image, applying recolor and upscaling.
-//
-// If the input image is *image.Paletted, the output will always be of that type too.
-func postProcImage(img image.Image) image.Image {
-	img = recolor(img)
+// maskToMatrix turns the image at path into an ordered dither matrix, with
+// the luminance of each pixel as its threshold. The luminance is stretched
+// so the darkest pixel is 0 and the brightest is 255.
+func maskToMatrix(path string) (dither.OrderedDitherMatrix, error) {
+	img, err := imaging.Open(path, autoOrientation)
+	if err != nil {
+		return dither.OrderedDitherMatrix{}, fmt.Errorf("error loading mask '%s': %w", path, err)
+	}
 
-	if upscale == 1 {
-		return img
+	b := img.Bounds()
+	grays := make([][]uint8, b.Dy())
+	var lo, hi uint8 = 255, 0
+	for y := range grays {
+		grays[y] = make([]uint8, b.Dx())
+		for x := range grays[y] {
+			v := color.GrayModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.Gray).Y
+			grays[y][x] = v
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+	}
+	if lo == hi {
+		return dither.OrderedDitherMatrix{}, fmt.Errorf("mask '%s' is a single color, it needs different shades to be used as a pattern", path)
 	}
 
-	var palette color.Palette
-	if p, ok := img.(*image.Paletted); ok {
-		palette = p.Palette
+	matrix := dither.OrderedDitherMatrix{
+		Matrix: make([][]uint, len(grays)),
+		Max:    256,
+	}
+	for y, row := range grays {
+		matrix.Matrix[y] = make([]uint, len(row))
+		for x, v := range row {
+			matrix.Matrix[y][x] = uint(math.Round(float64(v-lo) * 255 / float64(hi-lo)))
+		}
 	}
+	return matrix, nil
+}
 
-	img = imaging.Resize(
-		img,
-		img.Bounds().Dx()*upscale,
-		0,
-		imaging.NearestNeighbor,
-	)
+// ditherImage dithers the image with the Ditherer, or with specialDither if
+// it's set. Like (*dither.Ditherer).Dither, it may change the provided image.
+func ditherImage(d *dither.Ditherer, img image.Image) image.Image {
+	if specialDither != nil {
+		return specialDither(img)
+	}
+	return didder.DitherWith(d, img)
+}
+
+// ditherPaletted is like (*dither.Ditherer).DitherPaletted, but it dithers a
+// 16-bit copy of the image instead of an 8-bit one, so no precision is lost
+// before dithering. The palette ends with the reserved GIF entries, if there
+// are any.
+func ditherPaletted(d *dither.Ditherer, img image.Image) *image.Paletted {
+	if specialDither != nil {
+		return withGIFPalette(specialDither(img), img)
+	}
+
+	src := image.NewRGBA64(img.Bounds())
+	copyImage(src, img)
+	p := image.NewPaletted(src.Bounds(), d.GetPalette())
+	copyImage(p, didder.DitherWith(d, src))
+	return withGIFPalette(p, img)
+}
+
+// stretchContrast stretches the histogram of the image so that its darkest
+// pixels become black and its brightest pixels become white. The darkest and
+// brightest 0.5% of pixels are ignored, so a few outliers don't prevent the
+// stretch. All channels are stretched the same amount, based on luminance, so
+// colors don't shift.
+func stretchContrast(img image.Image) image.Image {
+	const clip = 0.005
+
+	// Luminance histogram
+	var hist [256]int
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				continue
+			}
+			hist[color.GrayModel.Convert(color.NRGBA{c.R, c.G, c.B, 255}).(color.Gray).Y]++
+		}
+	}
+	total := 0
+	for _, n := range hist {
+		total += n
+	}
+	if total == 0 {
+		return img
+	}
+
+	// Find the luminance values to stretch to black and white
+	lo, hi := 0, 255
+	for count := 0; lo < 255; lo++ {
+		count += hist[lo]
+		if float64(count) > clip*float64(total) {
+			break
+		}
+	}
+	for count := 0; hi > 0; hi-- {
+		count += hist[hi]
+		if float64(count) > clip*float64(total) {
+			break
+		}
+	}
+	if hi <= lo {
+		// Image is one flat color
+		return img
+	}
+
+	scale := 255 / float64(hi-lo)
+	stretch := func(v uint8) uint8 {
+		return uint8(math.Max(math.Min(math.Round((float64(v)-float64(lo))*scale), 255), 0))
+	}
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{stretch(c.R), stretch(c.G), stretch(c.B), c.A}
+	})
+}
+
+// From dither library
+
+func copyImage(dst draw.Image, src image.Image) {
+	draw.Draw(dst, src.Bounds(), src, src.Bounds().Min, draw.Src)
+}
+func copyOfImage(img image.Image) *image.RGBA {
+	dst := image.NewRGBA(img.Bounds())
+	copyImage(dst, img)
+	return dst
+}
+
+///////
+
+// recolor will recolor the image pixels if necessary. It should be called
+// before writing any image. It should only be given a dithered image.
+// It will copy an image if it cannot draw on it.
+//
+// If the input image is *image.Paletted, the output will always be of that type too.
+func recolor(src image.Image) image.Image {
+	if len(recolorPalette) == 0 {
+		return src
+	}
+
+	// Modified and returned value
+	var img draw.Image
+
+	// getRecolor takes an image color and returns the recolor one
+	getRecolor := func(a color.Color) color.Color {
+		// palette and recolorPalette are both NRGBA, so use that here too
+		c := color.NRGBAModel.Convert(a).(color.NRGBA)
+
+		// Alpha is ignored because the palette used for dithering is always
+		// opaque. Palette colors with alpha are dithered as opaque and get
+		// their alpha back here, through recolorPalette. The image might
+		// have a different alpha at that point, so it can't be matched
+		c.A = 255
+		if rc, ok := recolorMap[c]; ok {
+			return rc
+		}
+		// This should never happen
+		return recolorPalette[0]
+	}
+
+	// Fast path for paletted images
+	if p, ok := src.(*image.Paletted); ok {
+		// For each color in the image palette, replace it with the equivalent
+		// recolor palette color
+		for i, c := range ditheredPalette(p) {
+			p.Palette[i] = getRecolor(c)
+		}
+		return p
+	}
+
+	var ok bool
+	if img, ok = src.(draw.Image); !ok {
+		// Can't be changed
+		// Instead make a copy and recolor and return that
+		img = copyOfImage(src)
+	}
+
+	// Swap each image pixel
+
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			// Image pixel -> convert to RGBA -> find recolor palette color using map
+			// -> set color
+			c := getRecolor(img.At(x, y))
+			if recolorKeepAlpha {
+				// Only swap the RGB
+				rc := c.(color.NRGBA)
+				rc.A = color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA).A
+				c = rc
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// postProcImage post-processes the image, applying recolor and upscaling.
+//
+// If the input image is *image.Paletted, the output will always be of that type too.
+func postProcImage(img image.Image) image.Image {
+	return resizeOutput(recolor(img))
+}
+
+// resizeOutput does the post-processing that changes the size of the image,
+// like --upscale, --tile, and --pad. If the input image is *image.Paletted, the output
+// will be too.
+func resizeOutput(img image.Image) image.Image {
+	if matchInputSize {
+		img = resizeNearest(img, inputSize.X, inputSize.Y)
+	} else if upscaleX != 1 || upscaleY != 1 {
+		img = resizeNearest(img, img.Bounds().Dx()*upscaleX, img.Bounds().Dy()*upscaleY)
+	}
+	if tileSize.X != 0 {
+		img = tileImage(img, tileSize.X, tileSize.Y, tileMirror)
+	}
+	if padding != 0 {
+		img = padImage(img, padding, padColor)
+	}
+	return img
+}
+
+// padImage returns a copy of the image with a border of n pixels of the color
+// around it. If the input image is *image.Paletted, the output will be too,
+// and the border uses the palette entry of the color. If the color isn't in
+// the palette, like for separation masks, the first entry is used.
+func padImage(img image.Image, n int, c color.Color) image.Image {
+	b := img.Bounds()
+	rect := image.Rect(0, 0, b.Dx()+n*2, b.Dy()+n*2)
+
+	var dst draw.Image
+	if p, ok := img.(*image.Paletted); ok {
+		pp := image.NewPaletted(rect, p.Palette)
+		if i := colorIndex(p.Palette, color.NRGBAModel.Convert(c).(color.NRGBA)); i != -1 {
+			for j := range pp.Pix {
+				pp.Pix[j] = uint8(i)
+			}
+		}
+		dst = pp
+	} else {
+		dst = imaging.New(rect.Dx(), rect.Dy(), c)
+	}
+	draw.Draw(dst, b.Sub(b.Min).Add(image.Pt(n, n)), img, b.Min, draw.Src)
+	return dst
+}
+
+// tileImage repeats the image to fill a new image of the provided size,
+// starting from the top left. If mirror is true, every other column of tiles
+// is flipped horizontally and every other row vertically, so the edges of
+// neighboring tiles always match. If the input image is *image.Paletted,
+// the output will be too.
+func tileImage(img image.Image, w, h int, mirror bool) image.Image {
+	var dst draw.Image
+	if p, ok := img.(*image.Paletted); ok {
+		dst = image.NewPaletted(image.Rect(0, 0, w, h), p.Palette)
+	} else {
+		dst = image.NewNRGBA(image.Rect(0, 0, w, h))
+	}
+
+	// Tiles indexed by whether they're in an odd column and an odd row
+	tiles := [2][2]image.Image{{img, img}, {img, img}}
+	if mirror {
+		tiles[1][0] = imaging.FlipH(img)
+		tiles[0][1] = imaging.FlipV(img)
+		tiles[1][1] = imaging.Rotate180(img)
+	}
+
+	b := img.Bounds()
+	for row, y := 0, 0; y < h; row, y = row+1, y+b.Dy() {
+		for col, x := 0, 0; x < w; col, x = col+1, x+b.Dx() {
+			tile := tiles[col%2][row%2]
+			draw.Draw(dst, image.Rect(x, y, x+b.Dx(), y+b.Dy()), tile, tile.Bounds().Min, draw.Src)
+		}
+	}
+	return dst
+}
+
+// resizeNearest resizes the image with nearest-neighbor scaling, which keeps
+// the colors the same. If the input image is *image.Paletted, the output will
+// be too.
+func resizeNearest(img image.Image, w, h int) image.Image {
+	if img.Bounds().Dx() == w && img.Bounds().Dy() == h {
+		return img
+	}
+
+	var palette color.Palette
+	if p, ok := img.(*image.Paletted); ok {
+		palette = p.Palette
+	}
+
+	img = imaging.Resize(img, w, h, imaging.NearestNeighbor)
 
 	if len(palette) == 0 {
 		return img
@@ -332,218 +1125,983 @@ func postProcImage(img image.Image) image.Image {
 	return pi
 }
 
+const (
+	swatchWidth   = 96
+	swatchHeight  = 48
+	swatchColumns = 8
+)
+
+// paletteSwatch renders each color of the palette as a rectangle, labeled with
+// its hex code. The returned image uses the palette directly, in the same
+// order, so the labels are drawn with whichever palette color contrasts most
+// with the rectangle they're on.
+func paletteSwatch(palette []color.Color) *image.Paletted {
+	cols := swatchColumns
+	if len(palette) < cols {
+		cols = len(palette)
+	}
+	rows := (len(palette) + cols - 1) / cols
+
+	img := image.NewPaletted(
+		image.Rect(0, 0, cols*swatchWidth, rows*swatchHeight),
+		color.Palette(palette),
+	)
+
+	// Luminance of each palette color, for picking the label color
+	lums := make([]float64, len(palette))
+	for i, c := range palette {
+		r, g, b, _ := c.RGBA()
+		lums[i] = 0.2126*float64(r) + 0.7152*float64(g) + 0.0722*float64(b)
+	}
+
+	face := basicfont.Face7x13
+	for i, c := range palette {
+		rect := image.Rect(0, 0, swatchWidth, swatchHeight).Add(
+			image.Pt((i%cols)*swatchWidth, (i/cols)*swatchHeight),
+		)
+		draw.Draw(img, rect, &image.Uniform{c}, image.Point{}, draw.Src)
+
+		// Pick label color
+		labelIdx := i
+		for j := range palette {
+			if math.Abs(lums[j]-lums[i]) > math.Abs(lums[labelIdx]-lums[i]) {
+				labelIdx = j
+			}
+		}
+
+		nc := c.(color.NRGBA)
+		d := &font.Drawer{
+			Dst:  img,
+			Src:  &image.Uniform{palette[labelIdx]},
+			Face: face,
+			Dot: fixed.P(
+				rect.Min.X+4,
+				rect.Max.Y-4-face.Descent,
+			),
+		}
+		d.DrawString(fmt.Sprintf("#%02x%02x%02x", nc.R, nc.G, nc.B))
+	}
+
+	return img
+}
+
+// compareImage returns a new image with the original image on the left and
+// the dithered and post-processed one on the right. The original image is
+// upscaled to match.
+func compareImage(orig, dithered image.Image) image.Image {
+	if matchInputSize {
+		orig = imaging.Resize(orig, inputSize.X, inputSize.Y, imaging.NearestNeighbor)
+	} else if upscaleX != 1 || upscaleY != 1 {
+		orig = imaging.Resize(
+			orig,
+			orig.Bounds().Dx()*upscaleX,
+			orig.Bounds().Dy()*upscaleY,
+			imaging.NearestNeighbor,
+		)
+	}
+
+	ob := orig.Bounds()
+	db := dithered.Bounds()
+	h := ob.Dy()
+	if db.Dy() > h {
+		h = db.Dy()
+	}
+
+	img := imaging.New(ob.Dx()+db.Dx(), h, color.Transparent)
+	img = imaging.Paste(img, orig, image.Pt(0, 0))
+	img = imaging.Paste(img, dithered, image.Pt(ob.Dx(), 0))
+	return img
+}
+
+// errorMap returns a grayscale image showing the quantization error of each
+// pixel, which is the difference in luminance between the original and
+// dithered images. Brighter pixels have more error. The difference is
+// calculated in linear RGB, and then converted to sRGB so small errors are
+// still visible.
+func errorMap(orig, dithered image.Image) *image.Gray {
+	luminance := func(c color.Color) float64 {
+		nc := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+		return 0.2126*linearize(float64(nc.R)/65535) +
+			0.7152*linearize(float64(nc.G)/65535) +
+			0.0722*linearize(float64(nc.B)/65535)
+	}
+
+	b := dithered.Bounds()
+	ob := orig.Bounds()
+	img := image.NewGray(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			diff := math.Abs(
+				luminance(orig.At(x-b.Min.X+ob.Min.X, y-b.Min.Y+ob.Min.Y)) -
+					luminance(dithered.At(x, y)),
+			)
+			img.SetGray(x, y, color.Gray{uint8(math.Round(delinearize(diff) * 255))})
+		}
+	}
+	return img
+}
+
+// writeErrorMap writes the error map of the images to debugErrorPath as a PNG.
+func writeErrorMap(orig, dithered image.Image) error {
+	file, path, err := openOutFile(debugErrorPath)
+	if err != nil {
+		return err
+	}
+	err = (&png.Encoder{CompressionLevel: compLevel}).Encode(file, errorMap(orig, dithered))
+	if err != nil {
+		defer file.Abort()
+		return fmt.Errorf("error writing error map to '%s': %w", path, err)
+	}
+	return file.Close()
+}
+
+// outputPalette returns the palette colors used in output images, which is
+// the recolor palette if there is one.
+func outputPalette() []color.Color {
+	if len(recolorPalette) != 0 {
+		return recolorPalette
+	}
+	return palette
+}
+
+// padPalette returns a paletted version of a dithered and post-processed image,
+// with the palette padded to n colors. The PNG encoder picks the bit depth
+// based on the palette size, so this forces a specific bit depth.
+//
+// The palette order is always the same as the output palette, so index i is
+// the i-th color given by the user.
+func padPalette(img image.Image, n int) *image.Paletted {
+	var p *image.Paletted
+	if pi, ok := img.(*image.Paletted); ok {
+		p = &image.Paletted{
+			Pix:     pi.Pix,
+			Stride:  pi.Stride,
+			Rect:    pi.Rect,
+			Palette: append(color.Palette{}, pi.Palette...),
+		}
+	} else {
+		// All the image colors are already palette colors, so this won't
+		// change them
+		p = image.NewPaletted(img.Bounds(), append(color.Palette{}, outputPalette()...))
+		copyImage(p, img)
+	}
+
+	for len(p.Palette) < n {
+		// Unused entries
+		p.Palette = append(p.Palette, color.NRGBA{0, 0, 0, 255})
+	}
+	return p
+}
+
+// stripUnused returns a copy of the image with only the palette colors that
+// are used, in the same order, and the pixels changed to match.
+func stripUnused(p *image.Paletted) *image.Paletted {
+	var used [256]bool
+	b := p.Bounds()
+	for y := 0; y < b.Dy(); y++ {
+		for _, index := range p.Pix[y*p.Stride : y*p.Stride+b.Dx()] {
+			used[index] = true
+		}
+	}
+
+	// Old index to new index
+	var remap [256]uint8
+	pal := color.Palette{}
+	for i, c := range p.Palette {
+		if used[i] {
+			remap[i] = uint8(len(pal))
+			pal = append(pal, c)
+		}
+	}
+
+	np := image.NewPaletted(b, pal)
+	for y := 0; y < b.Dy(); y++ {
+		row := p.Pix[y*p.Stride : y*p.Stride+b.Dx()]
+		for x, index := range row {
+			np.Pix[y*np.Stride+x] = remap[index]
+		}
+	}
+	return np
+}
+
+// setTransparent makes the palette color at transparentIndex fully
+// transparent, if it's set. Encoders use the transparent palette color as
+// the transparent index.
+func setTransparent(p *image.Paletted) {
+	if transparentIndex == -1 {
+		return
+	}
+	c := color.NRGBAModel.Convert(p.Palette[transparentIndex]).(color.NRGBA)
+	c.A = 0
+	p.Palette[transparentIndex] = c
+}
+
+// encodeImage encodes a dithered and post-processed image in the provided
+// format.
+func encodeImage(w io.Writer, img image.Image, format string) error {
+	if format == "png" {
+		if pngBitDepth != 0 || indexed {
+			n := 0
+			if pngBitDepth != 0 {
+				n = 1 << pngBitDepth
+			}
+			p := padPalette(img, 0)
+			setTransparent(p)
+			if stripPalette {
+				p = stripUnused(p)
+			}
+			img = padPalette(p, n)
+		} else if _, ok := img.(*image.Paletted); ok && noIndex {
+			// The PNG encoder would write a paletted image as indexed
+			img = imaging.Clone(img)
+		} else if p, ok := img.(*image.Paletted); ok && stripPalette {
+			img = stripUnused(p)
+		}
+		return (&png.Encoder{CompressionLevel: compLevel}).Encode(w, img)
+	}
+	if format == "txt" {
+		return encodeText(w, img)
+	}
+	if format == "raw" {
+		return encodeRaw(w, img)
+	}
+	if format == "carray" {
+		return encodeCArray(w, img)
+	}
+
+	// GIF
+	// The gif package will not change the image if it's *image.Paletted.
+	// Otherwise all the image colors are already palette colors, so the
+	// palette is given as is, and draw.Src won't change any colors.
+
+	outPalette := gifPalette(outputPalette())
+	if transparentIndex != -1 || stripPalette {
+		// Make a paletted copy that can be changed
+		p := padPalette(img, 0)
+		setTransparent(p)
+		if stripPalette {
+			p = stripUnused(p)
+			outPalette = p.Palette
+		}
+		img = p
+	}
+
+	return gif.Encode(
+		w, img,
+		&gif.Options{
+			NumColors: len(outPalette),
+			Quantizer: &fakeQuantizer{outPalette},
+			Drawer:    draw.Src,
+		},
+	)
+}
+
+// channelMapper returns the PixelMapper created by newMapper for the provided
+// strength. If any per-channel strengths are set, a PixelMapper is created for
+// each channel and they are combined, so each channel is dithered with its own
+// strength. This works because ordered dithering changes each channel
+// independently.
+func channelMapper(newMapper func(strength float32) dither.PixelMapper, strength float32) dither.PixelMapper {
+	if !channelStrengthSet[0] && !channelStrengthSet[1] && !channelStrengthSet[2] {
+		return newMapper(strength)
+	}
+
+	var mappers [3]dither.PixelMapper
+	for i := range mappers {
+		if channelStrengthSet[i] {
+			mappers[i] = newMapper(channelStrength[i])
+		} else {
+			mappers[i] = newMapper(strength)
+		}
+	}
+	return func(x, y int, r, g, b uint16) (uint16, uint16, uint16) {
+		newR, _, _ := mappers[0](x, y, r, g, b)
+		_, newG, _ := mappers[1](x, y, r, g, b)
+		_, _, newB := mappers[2](x, y, r, g, b)
+		return newR, newG, newB
+	}
+}
+
+// splitmix64 is the finalizer of the SplitMix64 generator, which turns
+// similar inputs into very different outputs.
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// noiseAt returns a random number in the range [0, 1) that only depends on
+// the seed, pixel position, and channel. Unlike math/rand it has no state,
+// so it gives the same results no matter how many threads are dithering.
+func noiseAt(seed int64, x, y, channel int) float32 {
+	h := splitmix64(uint64(seed))
+	h = splitmix64(h ^ uint64(x))
+	h = splitmix64(h ^ uint64(y))
+	h = splitmix64(h ^ uint64(channel))
+	// Top 24 bits, which is all the precision a float32 has
+	return float32(h>>40) / (1 << 24)
+}
+
+// noiseDistributions lists the distributions of random noise, for the
+// --distribution flag of the random command.
+var noiseDistributions = []string{"uniform", "gaussian", "triangular"}
+
+// distNoiseAt is like noiseAt, but the noise follows the distribution, one of
+// noiseDistributions. The result is always in the range [0, 1], and the other
+// distributions are centered on 0.5.
+func distNoiseAt(dist string, seed int64, x, y, channel int) float32 {
+	switch dist {
+	case "triangular":
+		// The sum of two uniform values
+		return (noiseAt(seed, x, y, channel) + noiseAt(seed, x, y, channel+3)) / 2
+	case "gaussian":
+		// Box-Muller transform, scaled so the range covers three standard
+		// deviations each way
+		u1 := float64(noiseAt(seed, x, y, channel))
+		u2 := float64(noiseAt(seed, x, y, channel+3))
+		z := math.Sqrt(-2*math.Log(1-u1)) * math.Cos(2*math.Pi*u2)
+		return float32(math.Max(0, math.Min(1, 0.5+z/6)))
+	}
+	return noiseAt(seed, x, y, channel)
+}
+
+// seededNoiseGrayscale is like dither.RandomNoiseGrayscale, but the noise is
+// deterministic for the seed, without needing to dither single-threaded. The
+// noise follows the distribution, one of noiseDistributions.
+func seededNoiseGrayscale(dist string, seed int64, min, max float32) dither.PixelMapper {
+	return func(x, y int, r, g, b uint16) (uint16, uint16, uint16) {
+		// Same linear gray as the dither library
+		gray := (13933*uint32(r) + 46871*uint32(g) + 4732*uint32(b) + 1<<15) >> 16
+
+		new := dither.RoundClamp(float32(gray) + 65535.0*(distNoiseAt(dist, seed, x, y, 0)*(max-min)+min))
+		return new, new, new
+	}
+}
+
+// seededNoiseRGB is like dither.RandomNoiseRGB, but the noise is deterministic
+// for the seed, without needing to dither single-threaded. The noise follows
+// the distribution, one of noiseDistributions.
+func seededNoiseRGB(dist string, seed int64, minR, maxR, minG, maxG, minB, maxB float32) dither.PixelMapper {
+	return func(x, y int, r, g, b uint16) (uint16, uint16, uint16) {
+		return dither.RoundClamp(float32(r) + 65535.0*(distNoiseAt(dist, seed, x, y, 0)*(maxR-minR)+minR)),
+			dither.RoundClamp(float32(g) + 65535.0*(distNoiseAt(dist, seed, x, y, 1)*(maxG-minG)+minG)),
+			dither.RoundClamp(float32(b) + 65535.0*(distNoiseAt(dist, seed, x, y, 2)*(maxB-minB)+minB))
+	}
+}
+
+// frameStrength returns the strength for frame i out of n frames, when the
+// strength is being ramped.
+func frameStrength(i, n int) float32 {
+	if n <= 1 {
+		return strength
+	}
+	return strength + (strengthEnd-strength)*float32(i)/float32(n-1)
+}
+
+// loadStrengthFile reads a CSV file of input file names and strengths, one
+// per line, like "photo.jpg,60%". Lines starting with # are ignored.
+func loadStrengthFile(path string) (map[string]float32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	strengths := make(map[string]float32, len(records))
+	for _, record := range records {
+		s, err := parseStrength(strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", record[0], err)
+		}
+		strengths[record[0]] = s
+	}
+	return strengths, nil
+}
+
+// imageStrength returns the strength for input image i out of n. A strength
+// from --strength-file is used if there's one for the path or its base name,
+// and otherwise it's the ramped or regular strength.
+func imageStrength(path string, i, n int) float32 {
+	if s, ok := imageStrengths[path]; ok {
+		return s
+	}
+	if s, ok := imageStrengths[filepath.Base(path)]; ok {
+		return s
+	}
+	if strengthRamp {
+		return frameStrength(i, n)
+	}
+	return strength
+}
+
+// outFile is an output file that's written to a temporary file in the same
+// directory, and only moved into place by Close. That way an interrupted
+// write never leaves a partial file behind. Abort removes the temporary file
+// instead.
+type outFile struct {
+	*os.File
+	path   string // Final path, or empty for stdout
+	closed bool
+}
+
+// Close closes the file and moves it into place.
+func (f *outFile) Close() error {
+	f.closed = true
+	if f.path == "" {
+		return f.File.Close()
+	}
+	err := f.File.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if outFileFlags&os.O_EXCL != 0 {
+		// Unlike renaming, linking fails if the path already exists
+		err = os.Link(f.Name(), f.path)
+		if err != nil && linkUnsupported(err) {
+			// Filesystems without hard links, like FAT, can only be checked
+			// right before renaming
+			if _, statErr := os.Lstat(f.path); statErr == nil {
+				err = &fs.PathError{Op: "rename", Path: f.path, Err: fs.ErrExist}
+			} else {
+				err = os.Rename(f.Name(), f.path)
+			}
+		}
+		os.Remove(f.Name())
+	} else {
+		err = os.Rename(f.Name(), f.path)
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("'%s': %w", f.path, err)
+	}
+	// Only files that were fully written are in the manifest
+	addToManifest(f.path)
+	return nil
+}
+
+// linkUnsupported returns true if the error from os.Link means the filesystem
+// doesn't support hard links.
+func linkUnsupported(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+// Abort closes the file without moving it into place. For stdout it's just
+// closed. It does nothing if Close was already called.
+func (f *outFile) Abort() {
+	if f.closed {
+		return
+	}
+	f.File.Close()
+	if f.path != "" {
+		os.Remove(f.Name())
+	}
+}
+
+// stdinIsTerminal returns true if stdin is an interactive terminal, rather
+// than a pipe or file.
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	// The null device is a character device too
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(fi, null)
+}
+
+// askOverwrite asks on the terminal whether the path should be overwritten, if
+// it exists and promptOverwrite is set. It returns an error if the answer is
+// no. Answering "all" stops it from asking again.
+func askOverwrite(path string) error {
+	if !promptOverwrite {
+		return nil
+	}
+	if _, err := os.Lstat(path); err != nil {
+		return nil
+	}
+	if stdinReader == nil {
+		stdinReader = bufio.NewReader(os.Stdin)
+	}
+	for {
+		fmt.Fprintf(os.Stderr, "'%s' already exists, overwrite it? [y/N/all] ", path)
+		line, err := stdinReader.ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("not overwriting '%s': %w", path, fs.ErrExist)
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			return nil
+		case "a", "all":
+			promptOverwrite = false
+			return nil
+		case "", "n", "no":
+			return fmt.Errorf("not overwriting '%s': %w", path, fs.ErrExist)
+		}
+	}
+}
+
+// openOutFile opens the provided output path for writing, as an outFile. A
+// path of "-" returns stdout. The returned string is the path to use in error
+// messages.
+func openOutFile(path string) (*outFile, string, error) {
+	if path == "-" {
+		return &outFile{File: os.Stdout}, "stdout", nil
+	}
+	if outFileFlags&os.O_EXCL != 0 {
+		// Checked before writing anything, and again by Close
+		if _, err := os.Lstat(path); err == nil {
+			return nil, path, fmt.Errorf("'%s': %w", path, &fs.PathError{Op: "open", Path: path, Err: fs.ErrExist})
+		}
+	}
+	err := askOverwrite(path)
+	if err != nil {
+		return nil, path, err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, path, fmt.Errorf("'%s': %w", path, err)
+	}
+	// CreateTemp makes files only readable by the user, so give it the
+	// permissions a normal output file has
+	err = file.Chmod(0644)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, path, fmt.Errorf("'%s': %w", path, err)
+	}
+	return &outFile{File: file, path: path}, path, nil
+}
+
+// withPalette returns a copy of the Ditherer that uses a different palette.
+func withPalette(d *dither.Ditherer, pal []color.Color) *dither.Ditherer {
+	nd := dither.NewDitherer(pal)
+	nd.Mapper = d.Mapper
+	nd.Matrix = d.Matrix
+	nd.Serpentine = d.Serpentine
+	nd.SingleThreaded = d.SingleThreaded
+	return nd
+}
+
+// ditherAndWrite dithers a single input image and writes it out in each
+// output format. It's used for everything except animated GIFs. i is the
+// index of the image in inputImages.
+func ditherAndWrite(d *dither.Ditherer, img image.Image, i int, inputPath string, entry *reportEntry) error {
+	// Dither once, then write out the image in each output format
+
+	formats := append([]string{outFormat}, alsoFormats...)
+
+	var src image.Image
+	if compare || debugErrorPath != "" {
+		// Dithering can change the input image, so keep a copy
+		src = imaging.Clone(img)
+	}
+	if outFormat == "png" || len(alsoFormats) > 0 {
+		// PNG output is possible, so keep transparency
+		img = ditherImage(d, img)
+	} else {
+		// Non-animated output in a paletted format, like a single GIF, or
+		// txt, raw, and carray, which all need palette indexes
+		// Adapted from:
+		// https://github.com/makeworld-the-better-one/dither/blob/v2.0.0/examples/gif_image.go
+		img = ditherPaletted(d, img)
+	}
+	if reportUsage {
+		name := inputPath
+		if sizeSuffix != "" {
+			name += fmt.Sprintf(" (width %d)", width)
+		}
+		printUsage(name, img, d.GetPalette())
+	}
+	if separationsDir != "" {
+		err := writeSeparations(separationName(inputPath, i), img, d.GetPalette())
+		if err != nil {
+			return err
+		}
+	}
+	if debugErrorPath != "" {
+		err := writeErrorMap(src, img)
+		if err != nil {
+			return err
+		}
+	}
+	img = postProcImage(img)
+	if compare {
+		img = compareImage(src, img)
+	}
+	entry.Width, entry.Height = img.Bounds().Dx(), img.Bounds().Dy()
+
+	if preview {
+		err := printPreview(img)
+		if err != nil {
+			return err
+		}
+		if outPath == "" {
+			return nil
+		}
+	}
+
+	for _, format := range formats {
+		path := outPath
+		if outIsDir {
+			// Inside output directory
+			// Same name as input file but potentially different extension
+			name := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
+			if videoOutPath != "" {
+				// Frames are numbered in order for ffmpeg
+				name = fmt.Sprintf("%08d", i+1)
+			} else if numberFrames {
+				name = frameName(i)
+			}
+			path = filepath.Join(outPath, name+sizeSuffix+"."+formatExt(format))
+		} else if format != outFormat || sizeSuffix != "" {
+			// Same output path but with the extension of the extra format
+			path = strings.TrimSuffix(outPath, filepath.Ext(outPath)) + sizeSuffix + "." + formatExt(format)
+		}
+
+		file, path, err := openOutFile(path)
+		if err != nil {
+			return err
+		}
+		err = encodeImage(file, img, format)
+		if err != nil {
+			defer file.Abort() // Keep (possibly stdout) open to write error messages then close
+			return fmt.Errorf("error writing %s to '%s': %w", strings.ToUpper(format), path, err)
+		}
+		err = file.Close()
+		if err != nil {
+			return err
+		}
+
+		if videoOutPath != "" {
+			// Frames are temporary, the video is the real output
+			path = videoOutPath
+		} else if zipOutPath != "" {
+			// Path inside the zip
+			path = filepath.Join(zipOutPath, filepath.Base(path))
+		}
+		entry.Outputs = append(entry.Outputs, path)
+		entry.Formats = append(entry.Formats, format)
+	}
+	return nil
+}
+
+// frameName returns the name of the output file for the input image at index
+// i, for --number. Numbers start at 1, and are padded with zeros to at least
+// four digits, or more if needed to fit the number of images.
+func frameName(i int) string {
+	digits := len(strconv.Itoa(len(inputImages)))
+	if digits < 4 {
+		digits = 4
+	}
+	return fmt.Sprintf("frame_%0*d", digits, i+1)
+}
+
+// ditherSizes dithers and writes an input image at each width in sizes. The
+// image is only loaded once, so standard input works.
+func ditherSizes(d *dither.Ditherer, i int, inputPath string, entry *reportEntry) error {
+	orig, err := loadImage(inputPath)
+	if err != nil {
+		return fmt.Errorf("error loading '%s': %w", inputPath, err)
+	}
+	defer func() {
+		width = 0
+		sizeSuffix = ""
+	}()
+
+	for _, w := range sizes {
+		width = w
+		sizeSuffix = fmt.Sprintf("-%d", w)
+		// Resizing always makes a new image, so dithering won't change orig
+		err = ditherAndWrite(d, prepareImage(orig), i, inputPath, entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newAnimGIF returns an animated GIF of the frames, timed with the --fps and
+// --loop flags. The frames don't have to be set yet, but the slice must be the
+// right length.
+func newAnimGIF(frames []*image.Paletted, c *cli.Context) gif.GIF {
+	delays := make([]int, len(frames))
+	for i := range delays {
+		// Round to the nearest possible frame rate supported by the GIF format
+		// See for details: https://superuser.com/a/1449370
+		// A rolling average is not done because it's harder to code and looks
+		// bad: https://superuser.com/q/1459724
+		//
+		// Lowest allowed delay is 1, or 100 FPS.
+		delays[i] = int(math.Max(math.Round(100.0/globalFlag("fps", c).(float64)), 1))
+	}
+
+	loopCount := int(globalFlag("loop", c).(uint))
+	if loopCount == 1 {
+		// Looping once is set using -1 in the image/gif library
+		loopCount = -1
+	} else if loopCount != 0 {
+		// The CLI flag is equal to the number of times looped
+		// But for gif.GIF.LoopCount, "the animation is looped LoopCount+1 times."
+		loopCount -= 1
+	}
+	animGIF := gif.GIF{
+		Image:     frames,
+		Delay:     delays,
+		LoopCount: loopCount,
+	}
+
+	if gifDisposal != 0 {
+		animGIF.Disposal = make([]byte, len(frames))
+		for i := range animGIF.Disposal {
+			animGIF.Disposal[i] = gifDisposal
+		}
+	}
+	return animGIF
+}
+
 // processImages dithers all the input images and writes them.
 // It handles all image I/O.
-func processImages(d *dither.Ditherer, c *cli.Context) error {
-	outPath := globalFlag("out", c).(string)
+func processImages(d *dither.Ditherer, c *cli.Context) (err error) {
+	if jsonReportPath != "" {
+		defer func() {
+			reportErr := writeReport(err)
+			if err == nil {
+				err = reportErr
+			}
+		}()
+	}
 
 	// Setup for if it's an animated GIF output
 	// Overall adapted from:
 	// https://github.com/makeworld-the-better-one/dither/blob/v2.0.0/examples/gif_animation.go
 
 	isAnimGIF := len(inputImages) > 1 && outFormat == "gif" && !outIsDir
+	if isAnimGIF && perImagePalette {
+		return errors.New("--per-image-palette can't be used to create an animated GIF")
+	}
 
 	var frames []*image.Paletted
 	if isAnimGIF {
 		frames = make([]*image.Paletted, len(inputImages))
 	}
 
-	var delays []int
 	var animGIF gif.GIF
 	if isAnimGIF {
 		if !globalIsSet("fps", c) {
 			return errors.New("output will be animated GIF, but --fps flag is not set")
 		}
 
-		delays = make([]int, len(inputImages))
-		for i := range delays {
-			// Round to the nearest possible frame rate supported by the GIF format
-			// See for details: https://superuser.com/a/1449370
-			// A rolling average is not done because it's harder to code and looks
-			// bad: https://superuser.com/q/1459724
-			//
-			// Lowest allowed delay is 1, or 100 FPS.
-			delays[i] = int(math.Max(math.Round(100.0/globalFlag("fps", c).(float64)), 1))
-		}
+		animGIF = newAnimGIF(frames, c)
+	}
 
-		loopCount := int(globalFlag("loop", c).(uint))
-		if loopCount == 1 {
-			// Looping once is set using -1 in the image/gif library
-			loopCount = -1
-		} else if loopCount != 0 {
-			// The CLI flag is equal to the number of times looped
-			// But for gif.GIF.LoopCount, "the animation is looped LoopCount+1 times."
-			loopCount -= 1
-		}
-		animGIF = gif.GIF{
-			Image:     frames,
-			Delay:     delays,
-			LoopCount: loopCount,
+	if keepGoing && (isAnimGIF || videoOutPath != "") {
+		return errors.New("--keep-going can't be used for animated GIF or video output, because every frame is needed")
+	}
+
+	// skipFailed prints the error and returns true if the image should be
+	// skipped, because of --keep-going
+	failed := 0
+	var entry *reportEntry
+	skipFailed := func(err error) bool {
+		if !keepGoing {
+			return false
 		}
+		fmt.Fprintln(os.Stderr, err)
+		failed++
+		entry.Error = err.Error()
+		return true
 	}
 
 	// Go through images and dither (and write if not an animated GIF)
 
 	for i, inputPath := range inputImages {
 
+		entry = addReportEntry(inputPath)
+
+		if perImagePalette && i > 0 {
+			// The palette of the first image was already sampled in preProcess
+			pal, err := extractInputPalette(i)
+			if err == nil && len(pal) < 2 {
+				err = fmt.Errorf("the palette sampled from '%s' has less than two colors", inputPath)
+			}
+			if err != nil {
+				if skipFailed(err) {
+					continue
+				}
+				return err
+			}
+			if paletteSort != "" {
+				sortPalette(pal, nil, paletteSort)
+			}
+			palette = pal
+			grayscale = forceGrayscale || isGrayPalette(pal)
+			d = withPalette(d, pal)
+			entry.PaletteSize = len(pal)
+		}
+
+		if (strengthRamp || len(imageStrengths) > 0) && setStrength != nil {
+			setStrength(d, imageStrength(inputPath, i, len(inputImages)))
+		}
+
+		if len(sizes) != 0 {
+			err := ditherSizes(d, i, inputPath, entry)
+			if err != nil {
+				if skipFailed(err) {
+					continue
+				}
+				return err
+			}
+			entry.Success = true
+			continue
+		}
+
 		img, err := getInputImage(inputPath, c)
 		if err != nil {
-			return fmt.Errorf("error loading '%s': %w", inputPath, err)
+			err = fmt.Errorf("error loading '%s': %w", inputPath, err)
+			if skipFailed(err) {
+				continue
+			}
+			return err
 		}
 
 		if isAnimGIF {
 			if i == 0 {
 				// Use the config of the first image for the animated GIF
-				var config image.Config
-				frames[0], config = d.DitherPalettedConfig(img)
+				frames[0] = ditherPaletted(d, img)
+				if reportUsage {
+					printUsage(inputPath, frames[0], nil)
+				}
+				if separationsDir != "" {
+					err = writeSeparations(separationName(inputPath, 0), frames[0], nil)
+					if err != nil {
+						return err
+					}
+				}
 				frames[0] = postProcImage(frames[0]).(*image.Paletted)
+				setTransparent(frames[0])
+				if stripPalette {
+					frames[0] = stripUnused(frames[0])
+				}
 
-				if len(recolorPalette) == 0 {
-					animGIF.Config = config
-				} else {
-					// Same config as the Ditherer would give, but with the recolor palette
-					animGIF.Config = image.Config{
-						ColorModel: color.Palette(recolorPalette),
-						Width:      frames[0].Bounds().Dx(),
-						Height:     frames[0].Bounds().Dy(),
+				if preview {
+					// Only the first frame is previewed
+					err = printPreview(frames[0])
+					if err != nil {
+						return err
 					}
 				}
+
+				// Same config as the Ditherer would give, but with the recolor palette
+				// and transparency if needed, and the size after upscaling
+				animGIF.Config = image.Config{
+					ColorModel: frames[0].Palette,
+					Width:      frames[0].Bounds().Dx(),
+					Height:     frames[0].Bounds().Dy(),
+				}
+				entry.setFrame(frames[0])
 				continue
 			}
 			// Later frames
-			if upscale == 1 && !img.Bounds().Eq(frames[0].Bounds()) {
-				// Upscale check is needed because otherwise frames[0] will be upscaled and not match
+			if !postProcNeeded && !img.Bounds().Eq(frames[0].Bounds()) {
+				// Post-processing check is needed because otherwise frames[0] may be resized and not match
 				return fmt.Errorf(
 					"image '%s' isn't the same size as '%s', all sizes must match to create an animated GIF",
 					inputPath, inputImages[0],
 				)
 			}
-			frames[i] = d.DitherPaletted(img)
+			frames[i] = ditherPaletted(d, img)
+			if reportUsage {
+				printUsage(inputPath, frames[i], nil)
+			}
+			if separationsDir != "" {
+				err = writeSeparations(separationName(inputPath, i), frames[i], nil)
+				if err != nil {
+					return err
+				}
+			}
 			frames[i] = postProcImage(frames[i]).(*image.Paletted)
+			setTransparent(frames[i])
+			if stripPalette {
+				frames[i] = stripUnused(frames[i])
+			}
 
-			// Do bounds check now, if it didn't happen before because of upscaling
-			if upscale != 1 && !frames[i].Bounds().Eq(frames[0].Bounds()) {
+			// Do bounds check now, if it didn't happen before because of post-processing
+			if postProcNeeded && !frames[i].Bounds().Eq(frames[0].Bounds()) {
 				return fmt.Errorf(
 					"image '%s' isn't the same size as '%s', all sizes must match to create an animated GIF",
 					inputPath, inputImages[0],
 				)
 			}
+			entry.setFrame(frames[i])
 			continue
 		}
 
-		// Not an animated GIF
-		// Write out the image now
-		// (partially copied below, outside the loop)
-
-		var file io.WriteCloser
-		var path string
-
-		if outPath == "-" {
-			file = os.Stdout
-			path = "stdout"
-		} else {
-			if outIsDir {
-				// Inside output directory
-				// Same name as input file but potentially different extension
-				path = filepath.Join(
-					outPath,
-					strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))+"."+outFormat,
-				)
-			} else {
-				// Output file path
-				path = outPath
-			}
-
-			file, err = os.OpenFile(path, outFileFlags, 0644)
-			if err != nil {
-				return fmt.Errorf("'%s': %w", path, err)
+		err = ditherAndWrite(d, img, i, inputPath, entry)
+		if err != nil {
+			if skipFailed(err) {
+				continue
 			}
+			return err
 		}
+		entry.Success = true
+	}
 
-		if outFormat == "png" {
-			img = postProcImage(d.Dither(img))
-			err = (&png.Encoder{CompressionLevel: compLevel}).Encode(file, img)
-			if err != nil {
-				defer file.Close() // Keep (possibly stdout) open to write error messages then close
-				return fmt.Errorf("error writing PNG to '%s': %w", path, err)
-			}
-			file.Close()
-		} else {
-			// Output static GIF
-			// Adapted from:
-			// https://github.com/makeworld-the-better-one/dither/blob/v2.0.0/examples/gif_image.go
-
-			if !postProcNeeded {
-				// No post
-				// GIF encoder calls the ditherer
-				err = gif.Encode(
-					file, img,
-					&gif.Options{
-						NumColors: len(palette),
-						Quantizer: d,
-						Drawer:    d,
-					},
-				)
-			} else {
-				// Dither and post-process first, and use recolor palette if needed
-				// The gif package will not change the image if it's *image.Paletted
-				// So even though Drawer is not set to the ditherer it'll be fine,
-				// and the default FloydSteinberg Drawer won't be used
-
-				img = postProcImage(d.DitherPaletted(img))
-
-				var quantizer draw.Quantizer
-				if len(recolorPalette) == 0 {
-					quantizer = d
-				} else {
-					quantizer = &fakeQuantizer{recolorPalette}
-				}
-				err = gif.Encode(
-					file, img,
-					&gif.Options{
-						NumColors: len(recolorPalette),
-						Quantizer: quantizer,
-					},
-				)
-			}
-			if err != nil {
-				defer file.Close()
-				return fmt.Errorf("error writing GIF to '%s': %w", path, err)
-			}
-			file.Close()
+	if zipOutPath != "" {
+		// The images that did succeed are still archived with --keep-going
+		err = writeZip(outPath, zipOutPath)
+		if err != nil {
+			return err
 		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d images failed", failed, len(inputImages))
+		}
+		return nil
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d images failed", failed, len(inputImages))
 	}
 
 	// Either all images have been written and everything is done, or the animated GIF
-	// needs to be saved.
+	// or video needs to be saved.
 
+	if videoOutPath != "" {
+		err = askOverwrite(videoOutPath)
+		if err != nil {
+			return err
+		}
+		err = assembleVideo(outPath, videoOutPath, globalFlag("fps", c).(float64), outFileFlags&os.O_EXCL == 0)
+		if err != nil {
+			return err
+		}
+		addToManifest(videoOutPath)
+		return nil
+	}
 	if !isAnimGIF {
 		return nil
 	}
 
-	// Partially copied from above
-
-	var file io.WriteCloser
-	var path string
-	var err error
-
-	if outPath == "-" {
-		file = os.Stdout
-		path = "stdout"
-	} else {
-		// Output file path
-		path = outPath
-		file, err = os.OpenFile(path, outFileFlags, 0644)
-		if err != nil {
-			return fmt.Errorf("'%s': %w", path, err)
-		}
+	file, path, err := openOutFile(outPath)
+	if err != nil {
+		return err
 	}
 
 	err = gif.EncodeAll(file, &animGIF)
 	if err != nil {
-		defer file.Close()
+		defer file.Abort()
 		return fmt.Errorf("error writing GIF to '%s': %w", path, err)
 	}
-	file.Close()
-	return nil
+	return file.Close()
 }
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
 	"image/color"
+	"image/gif"
 	"image/png"
+	"io/fs"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -15,14 +20,11 @@ import (
 	"time"
 
 	"github.com/disintegration/imaging"
+	"github.com/makeworld-the-better-one/didder/pkg/didder"
 	"github.com/makeworld-the-better-one/dither/v2"
 	"github.com/urfave/cli/v2"
 )
 
-const (
-	unsupportedFormat string = "'%s' is an unsupported format, only 'png' or 'gif' are accepted"
-)
-
 var (
 	// palette stores the palette colors. It's set after pre-processing.
 	// Guaranteed to only hold color.NRGBA.
@@ -32,7 +34,48 @@ var (
 	// Guaranteed to only hold color.NRGBA.
 	recolorPalette []color.Color
 
-	grayscale bool
+	// recolorMap maps the RGB of each palette color (with alpha 255) to its
+	// recolor palette color, for quick lookups.
+	recolorMap map[color.NRGBA]color.Color
+
+	// recolorKeepAlpha is true when recoloring should keep the alpha of each
+	// pixel, instead of using the alpha of the recolor palette color
+	recolorKeepAlpha bool
+
+	// paletteSort is the order palette colors are sorted in, for
+	// --sort-palette. It's empty if they aren't sorted.
+	paletteSort string
+
+	// paletteSampleMethod is the method the palette is sampled from input
+	// images with, or empty if the palette isn't sampled.
+	paletteSampleMethod string
+	sampleColors        int
+	perImagePalette     bool
+
+	// rawInputSize is the size of raw input images, or zero if input images
+	// aren't raw. rawInputFormat is the pixel format of raw input images.
+	rawInputSize   image.Point
+	rawInputFormat string
+
+	// rampSpace is the color space ramp: palettes are interpolated in
+	rampSpace string
+
+	grayscale      bool
+	forceGrayscale bool // Set by the user, rather than by the palette
+	invert         bool
+	autoContrast   bool
+
+	// grayWeights are the RGB channel weights used to make images grayscale,
+	// or nil to use the default Rec. 601 luminance formula.
+	grayWeights []float64
+
+	// thresholdCurve maps 16-bit gray values so that dithering switches
+	// between palette levels at the --thresholds values. It's nil if the flag
+	// isn't set.
+	thresholdCurve []uint16
+
+	// Range 0,1
+	sepia float64
 
 	// Range -100,100
 
@@ -45,63 +88,462 @@ var (
 	inputImages []string
 	outFormat   string // "png" or "gif"
 	outIsDir    bool
+	keepGoing   bool // Skip images that fail instead of stopping
+	preview     bool // Print images to the terminal
+
+	// numberFrames is set by --number, to name files in the output directory
+	// by their position instead of their input name
+	numberFrames bool
+
+	// previewOpenPath is the output opened in the default viewer at the end,
+	// for --preview-open. It's empty if nothing should be opened.
+	previewOpenPath string
+
+	// outPath is where output is written. It's usually the --out flag, but
+	// it's a temporary directory for video output.
+	outPath string
+
+	// videoOutPath is the path of the output video, or empty if the output
+	// isn't video. The video is made from frames written to outPath.
+	videoOutPath string
+
+	// zipOutPath is the path of the output zip file, or empty if the output
+	// isn't a zip. The zip is made from images written to outPath.
+	zipOutPath string
+
+	// alsoFormats holds extra formats each image is written in, not
+	// including outFormat
+	alsoFormats []string
 
 	compLevel png.CompressionLevel
 
+	// pngBitDepth is 0 when the PNG encoder should choose
+	pngBitDepth int
+
+	// rawBits is the number of bits per pixel for raw output, and rawHeader
+	// is true when the width and height are written first
+	rawBits   int
+	rawHeader bool
+
+	// varName is the name of the array in carray output
+	varName string
+
+	// gifDisposal is the disposal method for every animated GIF frame, or 0
+	// to not set one
+	gifDisposal byte
+
+	// indexed is true when PNG output should always be paletted
+	indexed bool
+
+	// noIndex is true when PNG output should never be paletted
+	noIndex bool
+
+	// stripPalette is true when palette colors that aren't used by an image
+	// should be left out of its paletted output
+	stripPalette bool
+
+	// transparentIndex is the index of the palette color that's made
+	// transparent in paletted output, or -1
+	transparentIndex int
+
 	outFileFlags int // For os.OpenFile
 
+	// promptOverwrite is true when the user should be asked before an existing
+	// output file is overwritten
+	promptOverwrite bool
+
+	// stdinReader reads answers to prompts from stdin
+	stdinReader *bufio.Reader
+
 	width  int
 	height int
-	// upscale will always be 1 or above
-	upscale int
+
+	// matchInputSize is true when output images should be resized to the
+	// size of the input image, and inputSize holds the size of the current
+	// input image before it was resized
+	matchInputSize bool
+	inputSize      image.Point
+
+	// sizes are the widths each input image is dithered at, for --sizes.
+	// sizeSuffix is added to output file names, and is set for each size
+	// while images are processed.
+	sizes      []int
+	sizeSuffix string
+
+	// tileSize is the size output images are tiled to, or zero when
+	// they aren't tiled. With tileMirror every other tile is flipped.
+	tileSize   image.Point
+	tileMirror bool
+
+	// pixelSize is the size of each dithered pixel in the output, 0 or 1
+	// when not set
+	pixelSize int
+
+	// upscaleX and upscaleY will always be 1 or above
+	upscaleX int
+	upscaleY int
+
+	// padding is the size of the border added around output images, in the
+	// color padColor
+	padding  int
+	padColor color.Color
 
 	ditherer *dither.Ditherer
 
+	// seedIsSet is true when the global --seed flag was used, and randomness
+	// should be deterministic.
+	seedIsSet bool
+	seed      int64
+
 	// range [-1, 1]
 	strength float32
 
+	// strengthEnd is the strength of the last frame, when strengthRamp is true.
+	// The strength of each frame is interpolated between strength and strengthEnd.
+	strengthEnd  float32
+	strengthRamp bool
+
+	// imageStrengths maps input file names to strengths that override the
+	// others for that image. It's loaded from --strength-file.
+	imageStrengths map[string]float32
+
+	// channelStrength holds per-channel strengths for red, green, and blue,
+	// which override strength for that channel when set.
+	channelStrength    [3]float32
+	channelStrengthSet [3]bool
+
+	// specialDither is set by commands that don't use the Ditherer, and is
+	// used instead of it. The returned image must use the palette, in order.
+	specialDither func(img image.Image) *image.Paletted
+
+	// setStrength is set by commands that support --strength, and applies
+	// the provided strength to the ditherer. It's used to change the strength
+	// in-between frames.
+	setStrength func(d *dither.Ditherer, strength float32)
+
 	// Is post-processing needed?
 	postProcNeeded bool
+
+	// debugErrorPath is where the error map is written, if it's not empty
+	debugErrorPath string
+
+	// compare is true when the original image should be output next to the
+	// dithered one
+	compare bool
+
+	// stdinJSON holds a matrix read from stdin, so it can be used more than
+	// once
+	stdinJSON []byte
 )
 
 // preProcess is automatically called by the app before anything else.
 // It's run in the global context.
 func preProcess(c *cli.Context) error {
-	runtime.GOMAXPROCS(int(c.Uint("threads")))
+	// Images loaded here, like for sampling the palette, don't count as input
+	// being loaded, so flag errors after them are still usage errors
+	defer func() { inputLoaded = false }()
+
+	if c.IsSet("threads") {
+		threads := int(c.Uint("threads"))
+		if threads == 0 {
+			// Explicitly use all cores, rather than leaving GOMAXPROCS as is
+			threads = runtime.NumCPU()
+		}
+		runtime.GOMAXPROCS(threads)
+	}
 
 	var err error
-	palette, err = parseColors("palette", c)
-	if err != nil {
-		return err
+
+	autoOrientation = imaging.AutoOrientation(!c.Bool("no-exif-rotation"))
+	colorManaged = c.Bool("color-managed")
+
+	// Needed before palettes are parsed
+	rampSpace = strings.ToLower(c.String("ramp-space"))
+	if !containsString(didder.RampSpaces, rampSpace) {
+		return fmt.Errorf("ramp space '%s' is not valid, must be one of %s", rampSpace, strings.Join(didder.RampSpaces, ", "))
 	}
-	if len(palette) < 2 {
-		return errors.New("the palette must have at least two colors")
+	if c.Bool("linear") {
+		if c.IsSet("ramp-space") && rampSpace != "linear" {
+			return errors.New("--linear can't be used with a different --ramp-space")
+		}
+		rampSpace = "linear"
+	}
+
+	if c.IsSet("input-raw") {
+		rawInputSize, err = parseSize(c.String("input-raw"))
+		if err != nil {
+			return fmt.Errorf("input-raw: %w", err)
+		}
+	}
+	rawInputFormat = strings.ToLower(c.String("input-raw-format"))
+	if _, ok := rawPixelSizes[rawInputFormat]; !ok {
+		return fmt.Errorf("raw input format '%s' is not valid, must be rgb, rgba, or gray", rawInputFormat)
+	}
+	if c.IsSet("input-raw-format") && rawInputSize.X == 0 {
+		return errors.New("--input-raw-format needs --input-raw to be set")
+	}
+
+	// --in is required for every command except swatch, which has no input.
+	// It isn't marked as required so that swatch can work.
+	if len(c.StringSlice("in")) == 0 && c.Args().First() != "swatch" {
+		return errors.New("Required flag \"in\" not set")
+	}
+
+	// Glob matches are sorted, which matters for animated GIF frame order.
+	// Paths that are given one by one are kept in that order, and duplicate
+	// paths are always kept, so frames can be repeated.
+	sortType := c.String("sort")
+	if c.Bool("no-sort") {
+		if c.IsSet("sort") && sortType != "none" {
+			return errors.New("--no-sort and --sort can't be used together")
+		}
+		sortType = "none"
+	}
+	if !containsString([]string{"none", "name", "natural", "mtime"}, sortType) {
+		return fmt.Errorf("invalid sort type '%s'", sortType)
+	}
+
+	inputImages = make([]string, 0)
+	unmatched := make([]string, 0) // Glob patterns that matched nothing
+	for _, path := range c.StringSlice("in") {
+		if strings.Contains(path, "*") {
+			// Parse as glob
+			paths, err := filepath.Glob(path)
+			if err != nil {
+				return fmt.Errorf("bad glob pattern '%s': %w", path, err)
+			}
+			if len(paths) == 0 {
+				unmatched = append(unmatched, path)
+			}
+			sortPaths(paths, sortType)
+			inputImages = append(inputImages, paths...)
+		} else {
+			inputImages = append(inputImages, path)
+		}
+	}
+	if len(unmatched) > 0 {
+		if len(inputImages) == 0 {
+			return fmt.Errorf("no input images found, these patterns matched nothing: '%s'", strings.Join(unmatched, "', '"))
+		}
+		for _, pattern := range unmatched {
+			warn("the pattern '%s' matched nothing", pattern)
+		}
+	}
+
+	// Expand videos into their frames, and archives into their images
+	// This happens after sorting so the frames stay in order
+	expanded := make([]string, 0, len(inputImages))
+	for _, path := range inputImages {
+		var paths []string
+		var err error
+		if isVideo(path) {
+			paths, err = extractFrames(path)
+		} else if isArchive(path) {
+			paths, err = extractArchive(path)
+		} else {
+			paths = []string{path}
+		}
+		if err != nil {
+			return err
+		}
+		expanded = append(expanded, paths...)
+	}
+	inputImages = expanded
+
+	if c.String("frames") != "" {
+		start, end, step, err := parseFrameRange(c.String("frames"), len(inputImages))
+		if err != nil {
+			return fmt.Errorf("frames: %w", err)
+		}
+		selected := make([]string, 0)
+		for i := start; i < end; i += step {
+			selected = append(selected, inputImages[i])
+		}
+		inputImages = selected
+	}
+
+	keepGoing = c.Bool("keep-going")
+	jsonReportPath = c.String("json-report")
+	reportUsage = c.Bool("report-usage")
+	manifestPath = c.String("manifest")
+
+	if c.Bool("preflight") {
+		err = preflight(inputImages)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.String("gradient-map") != "" {
+		// Dither with evenly spaced grays, then recolor those grays to the
+		// gradient colors
+		if c.IsSet("palette") || c.IsSet("recolor") || c.Bool("invert-palette") {
+			return errors.New("--gradient-map can't be used with --palette, --recolor, or --invert-palette")
+		}
+		recolorPalette, err = parseColors("gradient-map", c)
+		if err != nil {
+			return err
+		}
+		if len(recolorPalette) < 2 {
+			return errors.New("the gradient map must have at least two colors")
+		}
+		palette = didder.GrayRamp(len(recolorPalette))
+	} else if !c.IsSet("palette") && c.Args().First() == "cmyk" {
+		// The cmyk command always outputs black and white, so a palette isn't
+		// needed
+		palette = []color.Color{color.NRGBA{0, 0, 0, 255}, color.NRGBA{255, 255, 255, 255}}
+	} else {
+		if !c.IsSet("palette") {
+			return errors.New("Required flag \"palette\" not set")
+		}
+		if method, ok := sampleMethod(c.String("palette")); ok {
+			paletteSampleMethod = method
+			sampleColors = int(c.Uint("sample-colors"))
+			palette, err = extractInputPalette(0)
+		} else {
+			palette, err = parseColors("palette", c)
+		}
+		if err != nil {
+			return err
+		}
+		if len(palette) < 2 {
+			return errors.New("the palette must have at least two colors")
+		}
+		if c.Bool("invert-palette") {
+			if c.Bool("per-image-palette") {
+				return errors.New("--invert-palette can't be used with --per-image-palette")
+			}
+			palette = invertColors(palette)
+		}
+
+		if c.String("recolor") != "" {
+			recolorPalette, err = parseColors("recolor", c)
+			if err != nil {
+				return err
+			}
+			if len(recolorPalette) != len(palette) {
+				return errors.New("recolor palette must have the same number of colors as the initial palette")
+			}
+		}
 	}
 
-	if c.String("recolor") != "" {
-		recolorPalette, err = parseColors("recolor", c)
+	if c.String("recolor-map") != "" {
+		if len(recolorPalette) != 0 {
+			return errors.New("--recolor-map can't be used with --recolor or --gradient-map")
+		}
+		recolorPalette, err = parseRecolorMap(c.String("recolor-map"))
 		if err != nil {
 			return err
 		}
-		if len(recolorPalette) != len(palette) {
-			return errors.New("recolor palette must have the same number of colors as the initial palette")
+	}
+
+	// Dithering ignores alpha, so palette colors with alpha are dithered as
+	// opaque, and then recolored to have their alpha
+	if len(recolorPalette) == 0 {
+		for i := range palette {
+			if palette[i].(color.NRGBA).A == 255 {
+				continue
+			}
+			recolorPalette = palette
+			palette = make([]color.Color, len(recolorPalette))
+			for j := range recolorPalette {
+				pc := recolorPalette[j].(color.NRGBA)
+				pc.A = 255
+				palette[j] = pc
+			}
+			break
+		}
+	}
+
+	// Recoloring finds the palette color of each pixel by its RGB value, so
+	// repeated palette colors can't be recolored differently
+	for i := range recolorPalette {
+		for j := 0; j < i; j++ {
+			if sameRGB(palette[i], palette[j]) && recolorPalette[i] != recolorPalette[j] {
+				return fmt.Errorf("palette color %s is repeated, but recolored to different colors", colorToHex(palette[i]))
+			}
+		}
+	}
+
+	// Repeated colors waste palette entries
+	for i := 1; i < len(palette); i++ {
+		if colorIndex(palette[:i], palette[i].(color.NRGBA)) == -1 {
+			continue
+		}
+		if !c.Bool("dedup-palette") {
+			warn("palette color %s is listed more than once, use --dedup-palette to remove repeats", colorToHex(palette[i]))
+			continue
+		}
+		// Recolor colors of repeats are the same, as checked above
+		palette = append(palette[:i:i], palette[i+1:]...)
+		if len(recolorPalette) != 0 {
+			recolorPalette = append(recolorPalette[:i:i], recolorPalette[i+1:]...)
+		}
+		i--
+	}
+	if len(palette) < 2 {
+		return errors.New("the palette must have at least two different colors")
+	}
+
+	switch order := strings.ToLower(c.String("sort-palette")); order {
+	case "none":
+	case "luminance", "hue":
+		paletteSort = order
+		sortPalette(palette, recolorPalette, paletteSort)
+	default:
+		return fmt.Errorf("palette sort order '%s' is not valid, must be one of none, luminance, or hue", c.String("sort-palette"))
+	}
+
+	recolorKeepAlpha = c.Bool("recolor-keep-alpha")
+	if recolorKeepAlpha && len(recolorPalette) == 0 {
+		return errors.New("--recolor-keep-alpha needs --recolor, --recolor-map, or --gradient-map")
+	}
+
+	recolorMap = make(map[color.NRGBA]color.Color, len(recolorPalette))
+	for i := range recolorPalette {
+		pc := palette[i].(color.NRGBA)
+		pc.A = 255
+		recolorMap[pc] = recolorPalette[i]
+	}
+
+	perImagePalette = c.Bool("per-image-palette")
+	if perImagePalette {
+		if paletteSampleMethod == "" {
+			return errors.New("--per-image-palette needs the palette to be sampled, like --palette sample")
+		}
+		if len(recolorPalette) != 0 {
+			return errors.New("--per-image-palette can't be used with --recolor or --recolor-map")
 		}
 	}
 
 	// Check if palette is grayscale and make image grayscale
 	// Or if the user forces it
 
-	grayscale = true
-	if !c.Bool("grayscale") {
-		// Grayscale isn't specified by the user
-		// So check to see if palette is grayscale
-		for _, c := range palette {
-			r, g, b, _ := c.RGBA()
-			if r != g || g != b {
-				grayscale = false
-				break
-			}
+	forceGrayscale = c.Bool("grayscale")
+	grayscale = forceGrayscale || isGrayPalette(palette)
+
+	if c.IsSet("grayscale-method") {
+		method := strings.ToLower(c.String("grayscale-method"))
+		var ok bool
+		grayWeights, ok = grayscaleMethods[method]
+		if !ok {
+			return fmt.Errorf("grayscale method '%s' is not valid, must be one of rec601, rec709, average, red, green, or blue", method)
 		}
+		if method == "rec601" {
+			// Default
+			grayWeights = nil
+		}
+	}
+
+	invert = c.Bool("invert")
+	autoContrast = c.Bool("auto-contrast")
+
+	sepia, err = parsePercentArg(c.String("sepia"), true)
+	if err != nil {
+		return fmt.Errorf("sepia: %w", err)
+	}
+	if sepia < 0 || sepia > 1 {
+		return errors.New("sepia must be in the range 0-100%")
 	}
 
 	saturation, err = parsePercentArg(c.String("saturation"), false)
@@ -109,6 +551,7 @@ func preProcess(c *cli.Context) error {
 		return fmt.Errorf("saturation: %w", err)
 	}
 	if saturation <= -100 {
+		forceGrayscale = true
 		grayscale = true
 		saturation = 0
 	}
@@ -121,32 +564,74 @@ func preProcess(c *cli.Context) error {
 		return fmt.Errorf("contrast: %w", err)
 	}
 
-	autoOrientation = imaging.AutoOrientation(!c.Bool("no-exif-rotation"))
-
-	inputImages = make([]string, 0)
-	for _, path := range c.StringSlice("in") {
-		if strings.Contains(path, "*") {
-			// Parse as glob
-			paths, err := filepath.Glob(path)
+	if c.String("thresholds") != "" {
+		if !isGrayPalette(palette) {
+			return errors.New("--thresholds only works with a grayscale palette")
+		}
+		if perImagePalette {
+			return errors.New("--thresholds can't be used with --per-image-palette")
+		}
+		args := parseArgs([]string{c.String("thresholds")}, " ,")
+		thresholds := make([]float64, len(args))
+		for i, arg := range args {
+			thresholds[i], err = parsePercentArg(arg, true)
 			if err != nil {
-				return fmt.Errorf("bad glob pattern '%s': %w", path, err)
+				return fmt.Errorf("thresholds: %w", err)
 			}
-			inputImages = append(inputImages, paths...)
-		} else {
-			inputImages = append(inputImages, path)
+		}
+		thresholdCurve, err = levelThresholdCurve(palette, thresholds)
+		if err != nil {
+			return fmt.Errorf("thresholds: %w", err)
 		}
 	}
 
 	formatVal := c.String("format")
-	if formatVal != "png" && formatVal != "gif" {
-		return fmt.Errorf(unsupportedFormat, formatVal)
+	if !isFormat(formatVal) {
+		return unsupportedFormat(formatVal)
 	}
 
 	// Figure out output format
 
+	preview = c.Bool("preview")
 	outVal := c.String("out")
+	outPath = outVal
+
+	if c.Bool("preview-open") {
+		if outVal == "-" {
+			return errors.New("--preview-open can't be used when outputting to stdout")
+		}
+		if !stdinIsTerminal() {
+			warn("--preview-open is ignored when not running in a terminal")
+		} else {
+			if outVal == "" {
+				if len(inputImages) > 1 && formatVal != "gif" {
+					return errors.New("--preview-open needs --out for multiple images, unless the format is GIF")
+				}
+				// The directory isn't removed at the end, so the viewer can
+				// still open the file
+				dir, err := os.MkdirTemp("", "didder-preview-")
+				if err != nil {
+					return fmt.Errorf("couldn't create temporary directory: %w", err)
+				}
+				outVal = filepath.Join(dir, "preview."+formatExt(formatVal))
+				outPath = outVal
+			}
+			previewOpenPath = outVal
+		}
+	}
 
-	if outVal == "-" {
+	// --out isn't marked as required so that it can be left out when previewing
+	if outVal == "" && !preview {
+		return errors.New("Required flag \"out\" not set")
+	}
+	if outVal == "-" && preview {
+		return errors.New("--preview can't be used when outputting to stdout")
+	}
+
+	if outVal == "" {
+		// Only previewing, nothing is written
+		outFormat = formatVal
+	} else if outVal == "-" {
 		// Outputting to stdout, so just use whatever the flag is
 		outFormat = formatVal
 	} else {
@@ -160,6 +645,20 @@ func preProcess(c *cli.Context) error {
 			outFormat = formatVal
 			outIsDir = true
 
+		} else if strings.ToLower(filepath.Ext(outVal)) == ".zip" {
+			// Write images to a temporary directory, and then zip them up
+			// Like a directory, the format comes from the flag
+			if err == nil && c.Bool("no-overwrite") {
+				return fmt.Errorf("'%s': %w", outVal, fs.ErrExist)
+			}
+			zipOutPath = outVal
+			outFormat = formatVal
+			outIsDir = true
+			outPath, err = makeTempDir()
+			if err != nil {
+				return err
+			}
+
 		} else {
 			// Outputting to file, that already exists
 			// Or something that doesn't exist - assumed to be a file
@@ -168,15 +667,32 @@ func preProcess(c *cli.Context) error {
 				// Format wasn't set, so ignore default value of "png"
 				// Try to figure out format from output filename
 				ext := strings.TrimPrefix(filepath.Ext(outVal), ".")
-				if ext == "png" || ext == "gif" {
+				if isFormat(extFormat(ext)) {
 					// Acceptable extension
-					outFormat = ext
+					outFormat = extFormat(ext)
+				} else if isVideo(outVal) {
+					// Write frames to a temporary directory, and then combine
+					// them into a video with ffmpeg
+					if !c.IsSet("fps") {
+						return errors.New("output will be video, but --fps flag is not set")
+					}
+					// Fail before any dithering is done
+					if _, err := findFFmpeg(); err != nil {
+						return err
+					}
+					videoOutPath = outVal
+					outFormat = "png"
+					outIsDir = true
+					outPath, err = makeTempDir()
+					if err != nil {
+						return err
+					}
 				} else if ext == "" {
 					// No extension, use default format
 					outFormat = "png"
 				} else {
 					// Unsupported extension and no format flag override
-					return fmt.Errorf(unsupportedFormat, ext)
+					return unsupportedFormat(ext)
 				}
 			} else {
 				// Format flag was set, so ignore what the file looks like
@@ -188,129 +704,462 @@ func preProcess(c *cli.Context) error {
 
 	// Multiple input images are only valid if the output is GIF,
 	// or if the output points to a directory.
-	if len(inputImages) > 1 && (outFormat != "gif" && !outIsDir) {
+	if len(inputImages) > 1 && (outFormat != "gif" && !outIsDir) && outVal != "" {
 		return fmt.Errorf("multiple input images are only allowed if the output format is GIF, or an existing directory")
 	}
 
-	if outFormat == "gif" && len(palette) > 256 {
-		return errors.New("the GIF format only supports 256 colors or less in the palette")
+	numberFrames = c.Bool("number")
+	if numberFrames && !outIsDir {
+		return errors.New("--number only works when outputting to a directory or zip file")
 	}
 
-	// Set PNG compression type
-
-	switch c.String("compression") {
-	case "default":
-		compLevel = png.DefaultCompression
-	case "no":
-		compLevel = png.NoCompression
-	case "speed":
-		compLevel = png.BestSpeed
-	case "size":
-		compLevel = png.BestCompression
-	default:
-		return fmt.Errorf("invalid compression type '%s'", c.String("compression"))
+	separationsDir = c.String("separations")
+	if separationsDir != "" {
+		err = os.MkdirAll(separationsDir, 0755)
+		if err != nil {
+			return fmt.Errorf("couldn't create separations directory: %w", err)
+		}
 	}
 
-	if c.Bool("no-overwrite") {
-		outFileFlags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
-	} else {
-		outFileFlags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if ((outIsDir && videoOutPath == "") || separationsDir != "") && !numberFrames {
+		// Outputs are named after the input images
+		err = checkArchiveNames(inputImages)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Set here for convenience
-	width = int(c.Uint("width"))
-	height = int(c.Uint("height"))
-	upscale = int(c.Uint("upscale"))
-	if upscale == 0 {
-		// Invalid
-		upscale = 1
+	alsoFormats = make([]string, 0)
+	for _, format := range c.StringSlice("also-format") {
+		if !isFormat(format) {
+			return unsupportedFormat(format)
+		}
+		if format == outFormat {
+			continue
+		}
+		if outVal == "-" {
+			return errors.New("--also-format can't be used when outputting to stdout")
+		}
+		if outVal == "" {
+			return errors.New("--also-format can't be used without --out")
+		}
+		if videoOutPath != "" {
+			return errors.New("--also-format can't be used with video output")
+		}
+		if len(inputImages) > 1 && !outIsDir {
+			return errors.New("--also-format can't be used with animated GIF output")
+		}
+		alsoFormats = append(alsoFormats, format)
 	}
 
-	ditherer = dither.NewDitherer(palette)
-
-	tmp, err := parsePercentArg(c.String("strength"), true)
-	if err != nil {
-		return fmt.Errorf("strength: %w", err)
-	}
-	strength = float32(tmp)
-	if strength == 0 {
-		// Ignore
-		strength = 1
+	charset = []rune(c.String("charset"))
+	if len(charset) < 2 {
+		return errors.New("--charset must have at least two characters")
 	}
 
-	if len(recolorPalette) != 0 || upscale > 1 {
-		postProcNeeded = true
+	debugErrorPath = c.String("debug-error")
+	if debugErrorPath != "" && len(inputImages) > 1 {
+		return errors.New("--debug-error can only be used with one input image")
 	}
 
-	return nil
-}
-
-func random(c *cli.Context) error {
-	args := parseArgs(c.Args().Slice(), " ,")
-
-	// Manually parse out --seed, -s flag
-	// The manual parsing is done to allow for numbers that start with a negative
-	// which would otherwise be interpreted as flags
-
-	seedIsSet := false
-	var seed int64
-
-	if len(args) >= 1 {
-		if args[0] == "--seed" || args[0] == "-s" {
-			if len(args) >= 2 {
-				// Parse and set seed value
+	compare = c.Bool("compare")
+	if compare && (outFormat != "png" || len(alsoFormats) > 0) {
+		return errors.New("--compare only supports PNG output")
+	}
 
-				var err error
-				seed, err = strconv.ParseInt(args[1], 10, 64)
-				if err != nil {
-					return fmt.Errorf("couldn't parse seed value: %w", err)
-				}
-				seedIsSet = true
-				args = args[2:]
-			} else {
-				// Seed flag but no value after it
-				return errors.New("no value after seed flag")
-			}
-		} else if args[0] == "--help" || args[0] == "-h" {
-			// Display the help
-			return cli.ShowCommandHelp(c, "random")
+	indexed = c.Bool("indexed")
+	if indexed {
+		if compare {
+			return errors.New("--indexed can't be used with --compare")
 		}
 	}
 
-	if len(args) != 2 && len(args) != 6 {
-		return errors.New("random needs 2 or 6 arguments")
+	switch c.String("disposal") {
+	case "":
+		gifDisposal = 0
+	case "none":
+		gifDisposal = gif.DisposalNone
+	case "background":
+		gifDisposal = gif.DisposalBackground
+	case "previous":
+		gifDisposal = gif.DisposalPrevious
+	default:
+		return fmt.Errorf("invalid disposal method '%s'", c.String("disposal"))
 	}
 
-	floatArgs := make([]float32, len(args))
-	for i, arg := range args {
-		f64, err := parsePercentArg(arg, true)
+	transparentIndex = -1
+	if c.String("transparent") != "" {
+		tc, err := parseColor("transparent", c.String("transparent"))
 		if err != nil {
 			return err
 		}
-		floatArgs[i] = float32(f64)
+		// Find it in the palette, or the recolor palette
+		// Either way the index is the same
+		transparentIndex = colorIndex(palette, tc)
+		if transparentIndex == -1 {
+			transparentIndex = colorIndex(recolorPalette, tc)
+		}
+		if transparentIndex == -1 {
+			return errors.New("transparent color must be one of the palette or recolor palette colors")
+		}
+		if outFormat != "gif" && !containsString(alsoFormats, "gif") && !indexed && c.Uint("png-bit-depth") == 0 {
+			return errors.New("--transparent only applies to GIF or indexed PNG output")
+		}
 	}
 
-	if seedIsSet {
-		rand.Seed(seed)
-	} else {
-		// Seed with something that won't repeat next use
-		rand.Seed(time.Now().UnixNano())
+	gifReserved = 0
+	if c.Bool("keep-transparency") {
+		if outFormat != "gif" || len(alsoFormats) > 0 {
+			return errors.New("--keep-transparency only applies to GIF output")
+		}
+		if transparentIndex != -1 {
+			return errors.New("--keep-transparency can't be used with --transparent")
+		}
+		// One GIF palette entry is kept for the transparent pixels
+		gifReserved = 1
+	}
+
+	noIndex = c.Bool("no-index")
+	if noIndex && (indexed || c.Uint("png-bit-depth") != 0) {
+		return errors.New("--no-index can't be used with --indexed or --png-bit-depth")
+	}
+	stripPalette = c.Bool("png-palette-only")
+
+	pngBitDepth = int(c.Uint("png-bit-depth"))
+	if pngBitDepth != 0 {
+		if pngBitDepth != 1 && pngBitDepth != 2 && pngBitDepth != 4 && pngBitDepth != 8 {
+			return errors.New("PNG bit depth must be 1, 2, 4, or 8")
+		}
+		if outFormat != "png" && !containsString(alsoFormats, "png") {
+			return errors.New("--png-bit-depth only applies to PNG output")
+		}
+		if compare {
+			return errors.New("--png-bit-depth can't be used with --compare")
+		}
+	}
+
+	rawBits = int(c.Uint("bits-per-pixel"))
+	if rawBits != 1 && rawBits != 2 && rawBits != 4 && rawBits != 8 {
+		return errors.New("bits per pixel must be 1, 2, 4, or 8")
+	}
+	rawHeader = c.Bool("raw-header")
+	if rawHeader && outFormat != "raw" && !containsString(alsoFormats, "raw") {
+		return errors.New("--raw-header only applies to raw output")
+	}
+	isPacked := outFormat == "raw" || outFormat == "carray" ||
+		containsString(alsoFormats, "raw") || containsString(alsoFormats, "carray")
+	if c.IsSet("bits-per-pixel") && !isPacked {
+		return errors.New("--bits-per-pixel only applies to raw or carray output")
+	}
+	varName = c.String("var-name")
+	if !cIdentifier.MatchString(varName) {
+		return fmt.Errorf("'%s' is not a valid C identifier", varName)
+	}
+
+	// Every flag that limits the palette size has been handled
+	maxPalette := len(palette)
+	if perImagePalette && sampleColors > maxPalette {
+		// Later images could have more colors
+		maxPalette = sampleColors
+	}
+	err = checkFormats(append([]string{outFormat}, alsoFormats...), maxPalette)
+	if err != nil {
+		return err
+	}
+
+	// Set PNG compression type
+
+	compLevel, err = parseCompression(c.String("compression"))
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("no-overwrite") {
+		outFileFlags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	} else {
+		outFileFlags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		// Only ask when someone can answer, so scripts don't get stuck
+		promptOverwrite = !c.Bool("yes") && stdinIsTerminal()
+	}
+
+	// Set here for convenience
+	width = int(c.Uint("width"))
+	height = int(c.Uint("height"))
+	upscaleX, upscaleY, err = parseUpscale(c.String("upscale"))
+	if err != nil {
+		return fmt.Errorf("upscale: %w", err)
+	}
+
+	pixelSize = int(c.Uint("pixel-size"))
+	if pixelSize > 1 {
+		if width != 0 || height != 0 || c.IsSet("upscale") {
+			return errors.New("--pixel-size can't be used with --width, --height, or --upscale")
+		}
+		// Images are shrunk by the same amount in getInputImage
+		upscaleX, upscaleY = pixelSize, pixelSize
+	}
+
+	matchInputSize = c.Bool("match-input-size")
+	if matchInputSize && c.IsSet("upscale") {
+		return errors.New("--match-input-size can't be used with --upscale")
+	}
+
+	if c.IsSet("sizes") {
+		for _, s := range strings.Split(c.String("sizes"), ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || n < 1 {
+				return fmt.Errorf("sizes: '%s' is not a width, only positive integers are allowed. Example: 320,640,1280", s)
+			}
+			sizes = append(sizes, n)
+		}
+		if width != 0 || height != 0 || pixelSize > 1 || matchInputSize {
+			return errors.New("--sizes can't be used with --width, --height, --pixel-size, or --match-input-size")
+		}
+		if outVal == "-" {
+			return errors.New("--sizes can't be used when outputting to stdout")
+		}
+		if videoOutPath != "" || (len(inputImages) > 1 && outFormat == "gif" && !outIsDir) {
+			return errors.New("--sizes can't be used with animated GIF or video output")
+		}
+	}
+
+	if c.IsSet("tile") {
+		tileSize, err = parseSize(c.String("tile"))
+		if err != nil {
+			return fmt.Errorf("tile: %w", err)
+		}
+		if compare {
+			return errors.New("--tile can't be used with --compare")
+		}
+	}
+	tileMirror = c.Bool("tile-mirror")
+	if tileMirror && tileSize.X == 0 {
+		return errors.New("--tile-mirror needs --tile to be set")
+	}
+
+	padding = int(c.Uint("pad"))
+	if c.IsSet("pad-color") && padding == 0 {
+		return errors.New("--pad-color needs --pad to be set")
+	}
+	if padding != 0 && compare {
+		return errors.New("--pad can't be used with --compare")
+	}
+	if padding != 0 {
+		// Padding is added after recoloring, so the color is the recolor
+		// color if there is one
+		outPalette := palette
+		if len(recolorPalette) != 0 {
+			outPalette = recolorPalette
+		}
+		i := lightestColor(palette)
+		if c.IsSet("pad-color") {
+			colors, err := parseColors("pad-color", c)
+			if err != nil {
+				return err
+			}
+			if len(colors) != 1 {
+				return errors.New("--pad-color must be a single color")
+			}
+			pc := color.NRGBAModel.Convert(colors[0]).(color.NRGBA)
+			i = colorIndex(palette, pc)
+			if i == -1 {
+				i = colorIndex(recolorPalette, pc)
+			}
+			if i == -1 {
+				return errors.New("pad color must be one of the palette or recolor palette colors")
+			}
+		}
+		padColor = outPalette[i]
+	}
+
+	// Check output sizes before anything is allocated, so a typo like
+	// --upscale 1000 fails instead of using up all the memory
+	if !c.Bool("force") && c.Uint64("max-pixels") != 0 {
+		for _, path := range inputImages {
+			n, err := outputPixels(path)
+			if err != nil {
+				// Errors are reported properly when the image is loaded
+				continue
+			}
+			if n > c.Uint64("max-pixels") {
+				return fmt.Errorf(
+					"output for '%s' would be %d pixels, which is over the limit of %d. Use --force or --max-pixels to allow it",
+					path, n, c.Uint64("max-pixels"),
+				)
+			}
+		}
+	}
+
+	ditherer = dither.NewDitherer(palette)
+
+	deterministic := c.Bool("deterministic")
+	if deterministic {
+		// Other Ditherers are made from this one, so they inherit this
+		ditherer.SingleThreaded = true
+	}
+
+	seedIsSet = c.IsSet("seed") || deterministic
+	if seedIsSet {
+		// The seed is 0 if only --deterministic is set
+		seed = c.Int64("seed")
+		rand.Seed(seed)
+	} else {
+		// Seed with something that won't repeat next use
+		rand.Seed(time.Now().UnixNano())
+	}
+
+	if strengthArgs := strings.Split(c.String("strength"), ":"); len(strengthArgs) == 2 {
+		// Ramp from one strength to another across frames
+		strength, err = parseStrength(strengthArgs[0])
+		if err != nil {
+			return fmt.Errorf("strength: %w", err)
+		}
+		strengthEnd, err = parseStrength(strengthArgs[1])
+		if err != nil {
+			return fmt.Errorf("strength: %w", err)
+		}
+		strengthRamp = true
+	} else if c.IsSet("strength") {
+		// An explicit zero is kept, and means no dithering
+		strength, err = parseStrength(c.String("strength"))
+		if err != nil {
+			return fmt.Errorf("strength: %w", err)
+		}
+	} else {
+		strength = 1
+	}
+
+	if c.String("strength-file") != "" {
+		imageStrengths, err = loadStrengthFile(c.String("strength-file"))
+		if err != nil {
+			return fmt.Errorf("strength-file: %w", err)
+		}
+		for name := range imageStrengths {
+			found := false
+			for _, path := range inputImages {
+				if path == name || filepath.Base(path) == name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				warn("strength file: '%s' doesn't match any input image", name)
+			}
+		}
+	}
+
+	for i, flag := range []string{"strength-r", "strength-g", "strength-b"} {
+		if !c.IsSet(flag) {
+			continue
+		}
+		tmp, err := parsePercentArg(c.String(flag), true)
+		if err != nil {
+			return fmt.Errorf("%s: %w", flag, err)
+		}
+		channelStrength[i] = float32(tmp)
+		channelStrengthSet[i] = true
+	}
+
+	if len(recolorPalette) != 0 || upscaleX > 1 || upscaleY > 1 || matchInputSize || tileSize.X != 0 || padding != 0 {
+		postProcNeeded = true
+	}
+
+	if c.String("export-palette") != "" {
+		// The palette colors as they appear in the output
+		err = exportPalette(outputPalette(), c.String("export-palette"))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func random(c *cli.Context) error {
+	if strengthRamp {
+		// random doesn't use the strength, so there's nothing to ramp
+		return errors.New("a strength ramp isn't supported for random")
+	}
+
+	args := parseArgs(c.Args().Slice(), " ,")
+
+	// Manually parse out the --seed, -s and --distribution, -d flags
+	// The manual parsing is done to allow for numbers that start with a negative
+	// which would otherwise be interpreted as flags
+	// The seed overrides the global --seed flag
+
+	seeded := seedIsSet
+	seed := seed
+	dist := "uniform"
+
+	for len(args) >= 1 {
+		if args[0] == "--seed" || args[0] == "-s" {
+			if len(args) < 2 {
+				// Seed flag but no value after it
+				return errors.New("no value after seed flag")
+			}
+			// Parse and set seed value
+			var err error
+			seed, err = strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("couldn't parse seed value: %w", err)
+			}
+			seeded = true
+			args = args[2:]
+		} else if args[0] == "--distribution" || args[0] == "-d" {
+			if len(args) < 2 {
+				return errors.New("no value after distribution flag")
+			}
+			dist = strings.ToLower(args[1])
+			if !containsString(noiseDistributions, dist) {
+				return fmt.Errorf("distribution '%s' is not valid, must be one of %s", args[1], strings.Join(noiseDistributions, ", "))
+			}
+			args = args[2:]
+		} else if args[0] == "--help" || args[0] == "-h" {
+			// Display the help
+			return cli.ShowCommandHelp(c, "random")
+		} else {
+			break
+		}
+	}
+
+	if !seeded && dist != "uniform" {
+		// The library only has uniform noise, so use the seeded noise with a
+		// seed that changes every time
+		seed = rand.Int63()
+		seeded = true
+	}
+
+	if len(args) != 2 && len(args) != 6 {
+		return errors.New("random needs 2 or 6 arguments")
+	}
+
+	floatArgs := make([]float32, len(args))
+	for i, arg := range args {
+		f64, err := parsePercentArg(arg, true)
+		if err != nil {
+			return err
+		}
+		floatArgs[i] = float32(f64)
 	}
 
 	if len(floatArgs) == 2 {
 		if grayscale {
-			ditherer.Mapper = dither.RandomNoiseGrayscale(floatArgs[0], floatArgs[1])
-		} else {
-			// Use the two arguments for all channels
-			ditherer.Mapper = dither.RandomNoiseRGB(floatArgs[0], floatArgs[1], floatArgs[0], floatArgs[1], floatArgs[0], floatArgs[1])
+			if seeded {
+				ditherer.Mapper = seededNoiseGrayscale(dist, seed, floatArgs[0], floatArgs[1])
+			} else {
+				ditherer.Mapper = dither.RandomNoiseGrayscale(floatArgs[0], floatArgs[1])
+			}
+			return processImages(ditherer, c)
 		}
+		// Use the two arguments for all channels
+		floatArgs = []float32{floatArgs[0], floatArgs[1], floatArgs[0], floatArgs[1], floatArgs[0], floatArgs[1]}
+	}
+	if seeded {
+		ditherer.Mapper = seededNoiseRGB(dist, seed, floatArgs[0], floatArgs[1], floatArgs[2], floatArgs[3], floatArgs[4], floatArgs[5])
 	} else {
 		ditherer.Mapper = dither.RandomNoiseRGB(floatArgs[0], floatArgs[1], floatArgs[2], floatArgs[3], floatArgs[4], floatArgs[5])
 	}
-	if seedIsSet {
-		// Make deterministic
-		ditherer.SingleThreaded = true
-	}
 
 	err := processImages(ditherer, c)
 	if err != nil {
@@ -320,17 +1169,38 @@ func random(c *cli.Context) error {
 }
 
 func bayer(c *cli.Context) error {
-	args := parseArgs(c.Args().Slice(), " ,x")
+	x, y, err := parseBayerArgs(c.Args().Slice())
+	if err != nil {
+		return err
+	}
+
+	setStrength = func(d *dither.Ditherer, strength float32) {
+		d.Mapper = channelMapper(func(strength float32) dither.PixelMapper {
+			return dither.Bayer(x, y, strength)
+		}, strength)
+	}
+	setStrength(ditherer, strength)
+
+	err = processImages(ditherer, c)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseBayerArgs parses the size of a Bayer matrix, like "4x4" or "4 4".
+func parseBayerArgs(rawArgs []string) (uint, uint, error) {
+	args := parseArgs(rawArgs, " ,x")
 
 	if len(args) != 2 {
-		return errors.New("bayer needs 2 arguments exactly. Example: 4x4")
+		return 0, 0, errors.New("bayer needs 2 arguments exactly. Example: 4x4")
 	}
 
 	uintArgs := make([]uint, 2)
 	for i, arg := range args {
 		u64, err := strconv.ParseUint(arg, 10, 0)
 		if err != nil {
-			return err
+			return 0, 0, err
 		}
 		uintArgs[i] = uint(u64)
 	}
@@ -338,163 +1208,552 @@ func bayer(c *cli.Context) error {
 	// Validate args to prevent dither.Bayer from panicking
 
 	x, y := uintArgs[0], uintArgs[1]
-	if x == 0 || y == 0 {
-		return errors.New("neither dimension can be 0")
+	err := didder.CheckBayerSize(x, y)
+	if err != nil {
+		return 0, 0, err
 	}
-	if x == 1 && y == 1 {
-		return errors.New("a 1x1 matrix will not dither the image")
+	return x, y, nil
+}
+
+func odm(c *cli.Context) error {
+	args := c.Args().Slice()
+
+	var matrix dither.OrderedDitherMatrix
+	var err error
+
+	if c.IsSet("mask") {
+		if len(args) != 0 {
+			return errors.New("odm doesn't accept an argument when --mask is used")
+		}
+		matrix, err = maskToMatrix(c.String("mask"))
+	} else if len(args) != 1 {
+		return errors.New("odm only accepts one argument")
+	} else {
+		matrix, err = parseODMArg(args[0])
 	}
-	if ((x&(x-1)) != 0 || (y&(y-1)) != 0) && // Power of two?
-		!((x == 3 && y == 3) || (x == 5 && y == 3) || (x == 3 && y == 5)) { // Exceptions
-		// Not a power of two, and not an exception
-		return errors.New("both dimensions must be powers of two")
+	if err != nil {
+		return err
 	}
 
-	ditherer.Mapper = dither.Bayer(x, y, strength)
+	setStrength = func(d *dither.Ditherer, strength float32) {
+		d.Mapper = channelMapper(func(strength float32) dither.PixelMapper {
+			return dither.PixelMapperFromMatrix(matrix, strength)
+		}, strength)
+	}
+	setStrength(ditherer, strength)
 
-	err := processImages(ditherer, c)
+	err = processImages(ditherer, c)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-var odmName = map[string]dither.OrderedDitherMatrix{
-	"clustereddot4x4":            dither.ClusteredDot4x4,
-	"clustereddotdiagonal8x8":    dither.ClusteredDotDiagonal8x8,
-	"vertical5x3":                dither.Vertical5x3,
-	"horizontal3x5":              dither.Horizontal3x5,
-	"clustereddotdiagonal6x6":    dither.ClusteredDotDiagonal6x6,
-	"clustereddotdiagonal8x8_2":  dither.ClusteredDotDiagonal8x8_2,
-	"clustereddotdiagonal16x16":  dither.ClusteredDotDiagonal16x16,
-	"clustereddot6x6":            dither.ClusteredDot6x6,
-	"clustereddotspiral5x5":      dither.ClusteredDotSpiral5x5,
-	"clustereddothorizontalline": dither.ClusteredDotHorizontalLine,
-	"clustereddotverticalline":   dither.ClusteredDotVerticalLine,
-	"clustereddot8x8":            dither.ClusteredDot8x8,
-	"clustereddot6x6_2":          dither.ClusteredDot6x6_2,
-	"clustereddot6x6_3":          dither.ClusteredDot6x6_3,
-	"clustereddotdiagonal8x8_3":  dither.ClusteredDotDiagonal8x8_3,
+// parseODMArg returns the ordered dither matrix for the argument of the odm
+// command, which is a matrix name, inline JSON, a path to a JSON file, or - for
+// stdin.
+func parseODMArg(arg string) (dither.OrderedDitherMatrix, error) {
+	matrix, ok := didder.OrderedMatrix(arg)
+	if ok {
+		return matrix, nil
+	}
+
+	// Either stdin, inline JSON, path to file, or an error
+	if arg == "-" {
+		err := readStdinJSON(&matrix)
+		if err != nil {
+			return matrix, err
+		}
+	} else if err := json.Unmarshal([]byte(arg), &matrix); err != nil {
+		bytes, err := os.ReadFile(arg)
+		if err != nil {
+			return matrix, errors.New("couldn't process argument as matrix name, inline JSON, or path to accessible JSON file")
+		}
+		err = json.Unmarshal(bytes, &matrix)
+		if err != nil {
+			return matrix, errors.New("couldn't process argument as matrix name, inline JSON, or path to accessible JSON file")
+		}
+	}
+
+	// Validate matrix
+
+	if matrix.Max == 0 {
+		return matrix, errors.New("the max value of the matrix cannot be 0")
+	}
+	if len(matrix.Matrix) == 0 {
+		return matrix, errors.New("matrix is empty")
+	}
+	// Is it rectangular?
+	width := len(matrix.Matrix[0])
+	if width == 0 {
+		return matrix, errors.New("matrix has empty row")
+	}
+	for _, row := range matrix.Matrix {
+		if len(row) != width {
+			return matrix, errors.New("matrix is not rectangular, all rows must be the same length")
+		}
+	}
+	return matrix, nil
 }
 
-func odm(c *cli.Context) error {
+func edm(c *cli.Context) error {
 	args := c.Args().Slice()
 
 	if len(args) != 1 {
-		return errors.New("odm only accepts one argument")
+		return errors.New("edm only accepts one argument")
+	}
+	if channelStrengthSet[0] || channelStrengthSet[1] || channelStrengthSet[2] {
+		// The error is diffused the same way for all channels
+		return errors.New("edm doesn't support per-channel strength")
 	}
 
-	var matrix dither.OrderedDitherMatrix
+	matrix, err := parseEDMArg(args[0])
+	if err != nil {
+		return err
+	}
 
-	matrix, ok := odmName[strings.ReplaceAll(strings.ToLower(args[0]), "-", "_")]
-	if !ok {
-		// Either inline JSON, path to file, or an error
-		err := json.Unmarshal([]byte(args[0]), &matrix)
-		if err != nil {
-			bytes, err := os.ReadFile(args[0])
-			if err != nil {
-				return errors.New("couldn't process argument as matrix name, inline JSON, or path to accessible JSON file")
-			}
-			err = json.Unmarshal(bytes, &matrix)
-			if err != nil {
-				return errors.New("couldn't process argument as matrix name, inline JSON, or path to accessible JSON file")
-			}
-		}
+	setStrength = func(d *dither.Ditherer, strength float32) {
+		d.Matrix = dither.ErrorDiffusionStrength(matrix, strength)
+	}
+	setStrength(ditherer, strength)
+	// Serpentine can be set globally or just for this command
+	if c.Bool("serpentine") || globalFlag("serpentine", c).(bool) {
+		ditherer.Serpentine = true
+	}
 
-		// Validate matrix
+	err = processImages(ditherer, c)
+	if err != nil {
+		return err
+	}
+	return nil
+}
 
-		if matrix.Max == 0 {
-			return errors.New("the max value of the matrix cannot be 0")
+// parseEDMArg returns the error diffusion matrix for the argument of the edm
+// command, which is a matrix name, inline JSON, a path to a JSON file, or - for
+// stdin.
+func parseEDMArg(arg string) (dither.ErrorDiffusionMatrix, error) {
+	matrix, ok := didder.DiffusionMatrix(arg)
+	if ok {
+		return matrix, nil
+	}
+
+	// Either stdin, inline JSON, path to file, or an error
+	if arg == "-" {
+		err := readStdinJSON(&matrix)
+		if err != nil {
+			return matrix, err
 		}
-		if len(matrix.Matrix) == 0 {
-			return errors.New("matrix is empty")
+	} else if err := json.Unmarshal([]byte(arg), &matrix); err != nil {
+		bytes, err := os.ReadFile(arg)
+		if err != nil {
+			return matrix, errors.New("couldn't process argument as matrix name, inline JSON, or path to accessible JSON file")
 		}
-		// Is it rectangular?
-		width := len(matrix.Matrix[0])
-		if width == 0 {
-			return errors.New("matrix has empty row")
+		err = json.Unmarshal(bytes, &matrix)
+		if err != nil {
+			return matrix, errors.New("couldn't process argument as matrix name, inline JSON, or path to accessible JSON file")
 		}
-		for _, row := range matrix.Matrix {
-			if len(row) != width {
-				return errors.New("matrix is not rectangular, all rows must be the same length")
-			}
+	}
+
+	// Validate matrix
+
+	if len(matrix) == 0 {
+		return matrix, errors.New("matrix is empty")
+	}
+	// Is it rectangular?
+	width := len(matrix[0])
+	if width == 0 {
+		return matrix, errors.New("matrix has empty row")
+	}
+	for _, row := range matrix {
+		if len(row) != width {
+			return matrix, errors.New("matrix is not rectangular, all rows must be the same length")
 		}
 	}
+	return matrix, nil
+}
+
+func swatch(c *cli.Context) error {
+	if len(c.Args().Slice()) != 0 {
+		return errors.New("swatch doesn't accept any arguments")
+	}
+	if outIsDir {
+		return errors.New("swatch can only output to a file or stdout, not a directory")
+	}
+	if outFormat != "png" && outFormat != "gif" {
+		// Only the PNG and GIF encoders are used below
+		return fmt.Errorf("swatch can't output %s, only png or gif", outFormat)
+	}
 
-	ditherer.Mapper = dither.PixelMapperFromMatrix(matrix, strength)
+	img := paletteSwatch(palette)
 
-	err := processImages(ditherer, c)
+	if preview {
+		err := printPreview(img)
+		if err != nil {
+			return err
+		}
+		if outPath == "" {
+			return nil
+		}
+	}
+
+	file, path, err := openOutFile(outPath)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	if outFormat == "png" {
+		err = (&png.Encoder{CompressionLevel: compLevel}).Encode(file, img)
+	} else {
+		// Image is already paletted with all the palette colors, so the GIF
+		// encoder won't change it
+		err = gif.Encode(file, img, &gif.Options{NumColors: len(palette)})
+	}
+	if err != nil {
+		defer file.Abort()
+		return fmt.Errorf("error writing swatch to '%s': %w", path, err)
+	}
+	return file.Close()
 }
 
-var edmName = map[string]dither.ErrorDiffusionMatrix{
-	"simple2d":            dither.Simple2D,
-	"floydsteinberg":      dither.FloydSteinberg,
-	"falsefloydsteinberg": dither.FalseFloydSteinberg,
-	"jarvisjudiceninke":   dither.JarvisJudiceNinke,
-	"atkinson":            dither.Atkinson,
-	"stucki":              dither.Stucki,
-	"burkes":              dither.Burkes,
-	"sierra":              dither.Sierra,
-	"sierra3":             dither.Sierra3,
-	"tworowsierra":        dither.TwoRowSierra,
-	"sierralite":          dither.SierraLite,
-	"sierra2_4a":          dither.Sierra2_4A,
-	"stevenpigeon":        dither.StevenPigeon,
+func binarizeCmd(c *cli.Context) error {
+	if len(c.Args().Slice()) != 0 {
+		return errors.New("binarize doesn't accept any arguments")
+	}
+
+	method, ok := binarizeMethods[strings.ToLower(c.String("method"))]
+	if !ok {
+		return fmt.Errorf("invalid binarization method '%s'", c.String("method"))
+	}
+	window := int(c.Uint("window"))
+	if window < 3 || window%2 == 0 {
+		return errors.New("window size must be an odd number, 3 or above")
+	}
+	k := c.Float64("k")
+	if !c.IsSet("k") && strings.ToLower(c.String("method")) == "niblack" {
+		// Niblack needs a negative k value to work well on dark text
+		k = -0.2
+	}
+
+	if perImagePalette {
+		return errors.New("binarize doesn't support --per-image-palette")
+	}
+
+	pal := ditherer.GetPalette()
+	specialDither = func(img image.Image) *image.Paletted {
+		return binarize(img, pal, method, window, k)
+	}
+
+	return processImages(ditherer, c)
 }
 
-func edm(c *cli.Context) error {
-	args := c.Args().Slice()
+func halftoneCmd(c *cli.Context) error {
+	if len(c.Args().Slice()) != 0 {
+		return errors.New("halftone doesn't accept any arguments")
+	}
+	if c.Float64("lpi") <= 0 || c.Float64("dpi") <= 0 {
+		return errors.New("lpi and dpi must be above zero")
+	}
+	// Size of each halftone cell in pixels
+	cell := c.Float64("dpi") / c.Float64("lpi")
+	if cell < 2 {
+		return errors.New("lpi is too high for the dpi, each halftone cell must be at least 2 pixels wide")
+	}
+	angle := c.Float64("angle")
+
+	specialDither = func(img image.Image) *image.Paletted {
+		// Global palette is used so --per-image-palette works
+		return halftone(img, palette, cell, angle)
+	}
 
+	return processImages(ditherer, c)
+}
+
+func hybridCmd(c *cli.Context) error {
+	specs := c.Args().Slice()
+	if len(specs) != 2 {
+		return errors.New("hybrid needs exactly two algorithms, global then local. Example: \"edm floydsteinberg\" \"bayer 8x8\"")
+	}
+	scale := int(c.Uint("scale"))
+	if scale < 2 {
+		return errors.New("scale must be 2 or above")
+	}
+	mix := c.Float64("mix")
+	if mix < 0 || mix > 1 {
+		return errors.New("mix must be between 0 and 1")
+	}
+
+	serpentine := c.Bool("serpentine") || globalFlag("serpentine", c).(bool)
+	global, err := algorithmDitherer(specs[0], serpentine)
+	if err != nil {
+		return err
+	}
+	local, err := algorithmDitherer(specs[1], serpentine)
+	if err != nil {
+		return err
+	}
+
+	specialDither = func(img image.Image) *image.Paletted {
+		// Global palette is used so --per-image-palette works
+		return hybridDither(img, withPalette(global, palette), withPalette(local, palette), scale, mix)
+	}
+
+	return processImages(ditherer, c)
+}
+
+func cmykCmd(c *cli.Context) error {
+	args := c.Args().Slice()
 	if len(args) != 1 {
-		return errors.New("edm only accepts one argument")
+		return errors.New("cmyk only accepts one argument, the ordered dither matrix. Example: clustereddot4x4")
+	}
+	matrix, err := parseODMArg(args[0])
+	if err != nil {
+		return err
 	}
 
-	var matrix dither.ErrorDiffusionMatrix
+	var angles [4]float64
+	angleArgs := strings.Split(c.String("angles"), ",")
+	if len(angleArgs) != 4 {
+		return errors.New("angles must be four comma-separated numbers, for cyan, magenta, yellow, and black")
+	}
+	for i, arg := range angleArgs {
+		angles[i], err = strconv.ParseFloat(strings.TrimSpace(arg), 64)
+		if err != nil {
+			return fmt.Errorf("angles: %s is not a number", arg)
+		}
+	}
 
-	matrix, ok := edmName[strings.ReplaceAll(strings.ToLower(args[0]), "-", "_")]
-	if !ok {
-		// Either inline JSON, path to file, or an error
-		err := json.Unmarshal([]byte(args[0]), &matrix)
+	if outPath == "" || outPath == "-" {
+		return errors.New("cmyk writes four files, so --out must be a file or directory")
+	}
+	if outFormat != "png" || len(alsoFormats) > 0 || videoOutPath != "" {
+		return errors.New("cmyk only supports PNG output")
+	}
+	if len(inputImages) > 1 && !outIsDir {
+		return errors.New("cmyk only accepts multiple input images when outputting to a directory")
+	}
+
+	// The image is separated into CMYK, so it shouldn't be made grayscale
+	// because of the palette
+	grayscale = forceGrayscale
+
+	for i, inputPath := range inputImages {
+		img, err := getInputImage(inputPath, c)
 		if err != nil {
-			bytes, err := os.ReadFile(args[0])
+			return fmt.Errorf("error loading '%s': %w", inputPath, err)
+		}
+		planes := cmykSeparations(img, matrix, strength, angles)
+		for j, plane := range planes {
+			var path string
+			if outIsDir {
+				path = filepath.Join(outPath, separationName(inputPath, i)+"-"+cmykInks[j]+".png")
+			} else {
+				path = strings.TrimSuffix(outPath, filepath.Ext(outPath)) + "-" + cmykInks[j] + ".png"
+			}
+
+			file, path, err := openOutFile(path)
+			if err != nil {
+				return err
+			}
+			err = (&png.Encoder{CompressionLevel: compLevel}).Encode(file, resizeOutput(plane))
 			if err != nil {
-				return errors.New("couldn't process argument as matrix name, inline JSON, or path to accessible JSON file")
+				defer file.Abort()
+				return fmt.Errorf("error writing %s separation to '%s': %w", cmykInks[j], path, err)
 			}
-			err = json.Unmarshal(bytes, &matrix)
+			err = file.Close()
 			if err != nil {
-				return errors.New("couldn't process argument as matrix name, inline JSON, or path to accessible JSON file")
+				return err
 			}
 		}
+	}
+
+	if zipOutPath != "" {
+		return writeZip(outPath, zipOutPath)
+	}
+	return nil
+}
 
-		// Validate matrix
+func montageCmd(c *cli.Context) error {
+	specs := c.Args().Slice()
+	if len(specs) == 0 {
+		return errors.New("montage needs at least one algorithm. Example: \"bayer 4x4\" \"edm floydsteinberg\"")
+	}
+	if len(inputImages) != 1 {
+		return errors.New("montage only accepts one input image")
+	}
+	if outIsDir {
+		return errors.New("montage can only output to a file or stdout, not a directory")
+	}
+	if outFormat != "png" || len(alsoFormats) > 0 {
+		return errors.New("montage only supports PNG output")
+	}
 
-		if len(matrix) == 0 {
-			return errors.New("matrix is empty")
+	serpentine := c.Bool("serpentine") || globalFlag("serpentine", c).(bool)
+	ditherers := make([]*dither.Ditherer, len(specs))
+	for i, spec := range specs {
+		var err error
+		ditherers[i], err = algorithmDitherer(spec, serpentine)
+		if err != nil {
+			return err
 		}
-		// Is it rectangular?
-		width := len(matrix[0])
-		if width == 0 {
-			return errors.New("matrix has empty row")
+	}
+
+	img, err := getInputImage(inputImages[0], c)
+	if err != nil {
+		return fmt.Errorf("error loading '%s': %w", inputImages[0], err)
+	}
+
+	cells := make([]image.Image, len(specs))
+	for i, d := range ditherers {
+		// Dithering can change the input image, so each cell gets a copy
+		cells[i] = postProcImage(didder.DitherWith(d, imaging.Clone(img)))
+	}
+
+	cols := int(c.Uint("columns"))
+	if cols == 0 {
+		cols = int(math.Ceil(math.Sqrt(float64(len(cells)))))
+	}
+	if cols > len(cells) {
+		cols = len(cells)
+	}
+	out := montage(cells, specs, cols)
+
+	if preview {
+		err := printPreview(out)
+		if err != nil {
+			return err
 		}
-		for _, row := range matrix {
-			if len(row) != width {
-				return errors.New("matrix is not rectangular, all rows must be the same length")
-			}
+		if outPath == "" {
+			return nil
 		}
 	}
 
-	ditherer.Matrix = dither.ErrorDiffusionStrength(matrix, strength)
-	if c.Bool("serpentine") {
-		ditherer.Serpentine = true
+	file, path, err := openOutFile(outPath)
+	if err != nil {
+		return err
+	}
+	err = (&png.Encoder{CompressionLevel: compLevel}).Encode(file, out)
+	if err != nil {
+		defer file.Abort()
+		return fmt.Errorf("error writing montage to '%s': %w", path, err)
 	}
+	return file.Close()
+}
 
-	err := processImages(ditherer, c)
+func diffCmd(c *cli.Context) error {
+	specs := c.Args().Slice()
+	if len(specs) != 2 {
+		return errors.New("diff needs exactly two algorithms. Example: \"bayer 4x4\" \"bayer 4x4@50%\"")
+	}
+	if len(inputImages) != 1 {
+		return errors.New("diff only accepts one input image")
+	}
+	if outIsDir {
+		return errors.New("diff can only output to a file or stdout, not a directory")
+	}
+	if outFormat != "png" || len(alsoFormats) > 0 {
+		return errors.New("diff only supports PNG output")
+	}
+
+	highlight, err := parseColor("color", c.String("color"))
 	if err != nil {
 		return err
 	}
-	return nil
+
+	serpentine := c.Bool("serpentine") || globalFlag("serpentine", c).(bool)
+	ditherers := make([]*dither.Ditherer, len(specs))
+	for i, spec := range specs {
+		ditherers[i], err = algorithmDitherer(spec, serpentine)
+		if err != nil {
+			return err
+		}
+	}
+
+	img, err := getInputImage(inputImages[0], c)
+	if err != nil {
+		return fmt.Errorf("error loading '%s': %w", inputImages[0], err)
+	}
+
+	// Dithering can change the input image, so each one gets a copy
+	a := postProcImage(didder.DitherWith(ditherers[0], imaging.Clone(img)))
+	b := postProcImage(didder.DitherWith(ditherers[1], imaging.Clone(img)))
+	out, n := diffImage(a, b, highlight)
+
+	total := out.Bounds().Dx() * out.Bounds().Dy()
+	fmt.Fprintf(os.Stderr, "%d of %d pixels differ (%.2f%%)\n", n, total, float64(n)/float64(total)*100)
+
+	if preview {
+		err := printPreview(out)
+		if err != nil {
+			return err
+		}
+		if outPath == "" {
+			return nil
+		}
+	}
+
+	file, path, err := openOutFile(outPath)
+	if err != nil {
+		return err
+	}
+	err = (&png.Encoder{CompressionLevel: compLevel}).Encode(file, out)
+	if err != nil {
+		defer file.Abort()
+		return fmt.Errorf("error writing diff to '%s': %w", path, err)
+	}
+	return file.Close()
+}
+
+func sweepCmd(c *cli.Context) error {
+	if len(c.Args().Slice()) != 0 {
+		return errors.New("sweep doesn't accept any arguments")
+	}
+	if len(inputImages) != 1 {
+		return errors.New("sweep only accepts one input image")
+	}
+	if outIsDir || outFormat != "gif" || len(alsoFormats) > 0 {
+		return errors.New("sweep can only output an animated GIF file")
+	}
+	if !globalIsSet("fps", c) {
+		return errors.New("output will be animated GIF, but --fps flag is not set")
+	}
+
+	serpentine := c.Bool("serpentine") || globalFlag("serpentine", c).(bool)
+	specs := sweepSpecs()
+	ditherers := make([]*dither.Ditherer, len(specs))
+	for i, spec := range specs {
+		var err error
+		ditherers[i], err = algorithmDitherer(spec, serpentine)
+		if err != nil {
+			return err
+		}
+	}
+
+	img, err := getInputImage(inputImages[0], c)
+	if err != nil {
+		return fmt.Errorf("error loading '%s': %w", inputImages[0], err)
+	}
+
+	frames := make([]*image.Paletted, len(specs))
+	for i, d := range ditherers {
+		frames[i] = postProcImage(ditherPaletted(d, img)).(*image.Paletted)
+		setTransparent(frames[i])
+	}
+
+	animGIF := newAnimGIF(frames, c)
+	animGIF.Config = image.Config{
+		ColorModel: frames[0].Palette,
+		Width:      frames[0].Bounds().Dx(),
+		Height:     frames[0].Bounds().Dy(),
+	}
+
+	file, path, err := openOutFile(outPath)
+	if err != nil {
+		return err
+	}
+	err = gif.EncodeAll(file, &animGIF)
+	if err != nil {
+		defer file.Abort()
+		return fmt.Errorf("error writing GIF to '%s': %w", path, err)
+	}
+	return file.Close()
 }
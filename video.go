@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// videoExts holds the file extensions that are treated as video, and handled
+// with ffmpeg.
+var videoExts = map[string]bool{
+	".mp4":  true,
+	".m4v":  true,
+	".mov":  true,
+	".mkv":  true,
+	".webm": true,
+	".avi":  true,
+}
+
+// tempDirs holds temporary directories that are removed by cleanup.
+var tempDirs []string
+
+// isVideo returns true if the path has a video file extension.
+func isVideo(path string) bool {
+	return videoExts[strings.ToLower(filepath.Ext(path))]
+}
+
+// makeTempDir creates a temporary directory that will be removed by cleanup.
+func makeTempDir() (string, error) {
+	dir, err := os.MkdirTemp("", "didder-")
+	if err != nil {
+		return "", fmt.Errorf("couldn't create temporary directory: %w", err)
+	}
+	tempDirs = append(tempDirs, dir)
+	return dir, nil
+}
+
+// cleanup is automatically called by the app after everything else, even if
+// there was an error.
+func cleanup(c *cli.Context) error {
+	var err error
+	if len(manifestFiles) > 0 {
+		// Whatever was written is listed, even if there was an error
+		err = writeManifest()
+	}
+	for _, dir := range tempDirs {
+		os.RemoveAll(dir)
+	}
+	return err
+}
+
+// findFFmpeg returns the path of the ffmpeg executable, or a helpful error if
+// it isn't installed.
+func findFFmpeg() (string, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", errors.New("ffmpeg is needed for video files, but it wasn't found. Make sure it's installed and in your PATH")
+	}
+	return ffmpeg, nil
+}
+
+// runFFmpeg runs ffmpeg with the provided args, and returns an error with
+// ffmpeg's output if it fails.
+func runFFmpeg(args ...string) error {
+	ffmpeg, err := findFFmpeg()
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(ffmpeg, append([]string{"-hide_banner", "-loglevel", "error"}, args...)...)
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// extractFrames uses ffmpeg to extract every frame of the video into a
+// temporary directory as a PNG, and returns the paths of those frames in order.
+func extractFrames(path string) ([]string, error) {
+	dir, err := makeTempDir()
+	if err != nil {
+		return nil, err
+	}
+	err = runFFmpeg("-i", path, "-vsync", "0", filepath.Join(dir, "%08d.png"))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting frames from '%s': %w", path, err)
+	}
+	// Numbers are zero-padded so lexical order is frame order
+	frames, err := filepath.Glob(filepath.Join(dir, "*.png"))
+	if err != nil {
+		return nil, err
+	}
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("no frames found in video '%s'", path)
+	}
+	return frames, nil
+}
+
+// assembleVideo uses ffmpeg to combine the numbered PNG frames in the
+// directory into a video at the output path.
+func assembleVideo(dir, out string, fps float64, overwrite bool) error {
+	overwriteFlag := "-n"
+	if overwrite {
+		overwriteFlag = "-y"
+	}
+	err := runFFmpeg(
+		overwriteFlag,
+		"-framerate", strconv.FormatFloat(fps, 'f', -1, 64),
+		"-i", filepath.Join(dir, "%08d.png"),
+		// Most video players need even dimensions and this pixel format
+		"-vf", "pad=ceil(iw/2)*2:ceil(ih/2)*2",
+		"-pix_fmt", "yuv420p",
+		out,
+	)
+	if err != nil {
+		return fmt.Errorf("error writing video to '%s': %w", out, err)
+	}
+	return nil
+}